@@ -0,0 +1,278 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const apiMediaType = "application/vnd.github.v3+json"
+
+// DefaultAPIVersion is the GitHub REST API version requested when
+// Options.APIVersion is empty.
+const DefaultAPIVersion = "2022-11-28"
+
+// apiVersionHeader is the header that selects the GitHub REST API version.
+const apiVersionHeader = "X-GitHub-Api-Version"
+
+// setAPIVersion sets the API version header on a REST API request.
+// It must be called after setCommonHeaders.
+func setAPIVersion(req *http.Request, opts Options) {
+	if opts.APIVersion == "" && req.Header.Get(apiVersionHeader) != "" {
+		// Keep a version set with Options.Header.
+		return
+	}
+	version := opts.APIVersion
+	if version == "" {
+		version = DefaultAPIVersion
+	}
+	req.Header.Set(apiVersionHeader, version)
+}
+
+func (opts Options) apiURL(path string) *url.URL {
+	var u *url.URL
+	switch {
+	case opts.APIURL != nil:
+		u = new(url.URL)
+		*u = *opts.APIURL
+	case opts.GitHubURL == nil:
+		u = &url.URL{
+			Scheme: "https",
+			Host:   "api.github.com",
+		}
+	case opts.GitHubURL.Host == "github.com":
+		// Keep the scheme so that API requests are checked the same way
+		// as requests to GitHubURL.
+		u = &url.URL{
+			Scheme: opts.GitHubURL.Scheme,
+			Host:   "api.github.com",
+		}
+	default:
+		u = opts.url("/api/v3")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	return u
+}
+
+// TokenInfo describes a GitHub access token, as reported by CheckToken.
+type TokenInfo struct {
+	// Login is the GitHub login of the user that owns the token.
+	Login string
+	// Scopes are the OAuth scopes granted to the token, as reported in the
+	// X-OAuth-Scopes header. It is empty for tokens without scopes and for
+	// tokens issued to GitHub Apps, which use fine-grained permissions instead.
+	Scopes Scopes
+}
+
+// ErrInvalidToken indicates that GitHub did not accept an access token,
+// usually because it has expired or has been revoked.
+var ErrInvalidToken = errors.New("token is invalid or revoked")
+
+// CheckToken asks GitHub who owns the given access token and which scopes it
+// has. If GitHub does not accept the token, the returned error matches
+// ErrInvalidToken when tested with errors.Is. opts.ClientID and opts.Prompter
+// are ignored.
+func CheckToken(ctx context.Context, opts Options, token string) (*TokenInfo, error) {
+	opts, done := opts.withTLSClient()
+	defer done()
+	info, err := checkToken(ctx, opts, token)
+	if err != nil {
+		return nil, fmt.Errorf("check github token: %w", err)
+	}
+	return info, nil
+}
+
+// checkTokensConcurrency is the maximum number of requests
+// that CheckTokens makes at once.
+const checkTokensConcurrency = 8
+
+// CheckTokens is like CheckToken, but checks several tokens concurrently,
+// for auditing a batch of stored tokens. The returned slice has an element
+// for each token, in the same order. If any token could not be checked, its
+// element is nil and CheckTokens returns a TokenErrors with the reasons.
+// If ctx is done, tokens that have not been checked yet fail with its error.
+func CheckTokens(ctx context.Context, opts Options, tokens []string) ([]*TokenInfo, error) {
+	opts, done := opts.withTLSClient()
+	defer done()
+	infos := make([]*TokenInfo, len(tokens))
+	errs := make(TokenErrors, len(tokens))
+	sem := make(chan struct{}, checkTokensConcurrency)
+	var wg sync.WaitGroup
+	for i, token := range tokens {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = fmt.Errorf("check github token: %w", doneError(ctx))
+			continue
+		}
+		wg.Add(1)
+		go func(i int, token string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			info, err := checkToken(ctx, opts, token)
+			if err != nil {
+				errs[i] = fmt.Errorf("check github token: %w", err)
+				return
+			}
+			infos[i] = info
+		}(i, token)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return infos, errs
+		}
+	}
+	return infos, nil
+}
+
+// TokenErrors is the error returned by CheckTokens. It has an element for
+// each token passed to CheckTokens: nil if the token was checked, or the
+// reason it could not be.
+type TokenErrors []error
+
+// Error reports how many tokens failed and the first failure.
+func (e TokenErrors) Error() string {
+	var first error
+	n := 0
+	for _, err := range e {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			n++
+		}
+	}
+	if n == 0 {
+		return "no errors"
+	}
+	return fmt.Sprintf("%d of %d tokens failed: %v", n, len(e), first)
+}
+
+// fetchLogin returns the login of the user that owns the given access token.
+func fetchLogin(ctx context.Context, opts Options, token string) (string, error) {
+	info, err := checkToken(ctx, opts, token)
+	if err != nil {
+		return "", err
+	}
+	return info.Login, nil
+}
+
+func checkToken(ctx context.Context, opts Options, token string) (*TokenInfo, error) {
+	u := opts.apiURL("/user")
+	if err := opts.checkURL(u); err != nil {
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+	req := (&http.Request{
+		Method: http.MethodGet,
+		URL:    u,
+		Header: http.Header{
+			"Accept":        {apiMediaType},
+			"Authorization": {"token " + token},
+		},
+	}).WithContext(ctx)
+	setCommonHeaders(req, opts)
+	setAPIVersion(req, opts)
+	resp, err := opts.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("get user: %v: %w (%v)", u, ErrInvalidToken, newHTTPError(u, resp))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get user: %v: %w", u, newHTTPError(u, resp))
+	}
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, fmt.Errorf("get user: %v: %w", u, err)
+	}
+	if user.Login == "" {
+		return nil, fmt.Errorf("get user: %v: server did not return a login", u)
+	}
+	info := &TokenInfo{Login: user.Login}
+	for _, scope := range strings.Split(resp.Header.Get("X-OAuth-Scopes"), ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			info.Scopes = append(info.Scopes, scope)
+		}
+	}
+	return info, nil
+}
+
+// RevokeToken revokes an access token issued to the OAuth application
+// identified by opts.ClientID (or opts.ClientIDByHost). GitHub requires the
+// application's client secret to revoke tokens. If GitHub does not know the
+// token, the returned error matches ErrInvalidToken when tested with errors.Is.
+func RevokeToken(ctx context.Context, opts Options, clientSecret, token string) error {
+	if opts.clientID() == "" {
+		return fmt.Errorf("revoke github token: client ID not provided")
+	}
+	opts, done := opts.withTLSClient()
+	defer done()
+	u := opts.apiURL("/applications/" + url.PathEscape(opts.clientID()) + "/token")
+	if err := opts.checkURL(u); err != nil {
+		return fmt.Errorf("revoke github token: %w", err)
+	}
+	body, err := json.Marshal(map[string]string{"access_token": token})
+	if err != nil {
+		return fmt.Errorf("revoke github token: %w", err)
+	}
+	req := (&http.Request{
+		Method: http.MethodDelete,
+		URL:    u,
+		GetBody: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		},
+		ContentLength: int64(len(body)),
+		Header: http.Header{
+			"Accept":       {apiMediaType},
+			"Content-Type": {jsonMediaType},
+		},
+	}).WithContext(ctx)
+	req.Body, _ = req.GetBody()
+	req.SetBasicAuth(opts.clientID(), clientSecret)
+	setCommonHeaders(req, opts)
+	setAPIVersion(req, opts)
+	resp, err := opts.client().Do(req)
+	if err != nil {
+		return fmt.Errorf("revoke github token: %w", err)
+	}
+	defer drainAndClose(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("revoke github token: %v: %w (%v)", u, ErrInvalidToken, newHTTPError(u, resp))
+	default:
+		return fmt.Errorf("revoke github token: %v: %w", u, newHTTPError(u, resp))
+	}
+}
@@ -0,0 +1,433 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFetchUser(t *testing.T) {
+	const token = "xyzzy"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/device/code", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("X-GitHub-Api-Version"); got != "" {
+			t.Errorf("X-GitHub-Api-Version = %q in device code request; want none", got)
+		}
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, url.Values{
+			"device_code":      {"abc"},
+			"user_code":        {"DED-BEF"},
+			"verification_uri": {"https://example.com/login/device"},
+			"interval":         {"1"},
+		}.Encode())
+	})
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("X-GitHub-Api-Version"); got != "" {
+			t.Errorf("X-GitHub-Api-Version = %q in access token request; want none", got)
+		}
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, url.Values{
+			"access_token": {token},
+			"token_type":   {"bearer"},
+		}.Encode())
+	})
+	mux.HandleFunc("/api/v3/user", func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("Authorization"), "token "+token; got != want {
+			t.Errorf("Authorization = %q; want %q", got, want)
+			http.Error(w, "Bad credentials", http.StatusUnauthorized)
+			return
+		}
+		if got := r.Header.Get("X-GitHub-Api-Version"); got != DefaultAPIVersion {
+			t.Errorf("X-GitHub-Api-Version = %q; want %q", got, DefaultAPIVersion)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		io.WriteString(w, `{"login":"octocat","id":1}`)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := RunFlow(context.Background(), Options{
+		ClientID:      "cafe1234",
+		GitHubURL:     u,
+		AllowInsecure: true,
+		HTTPClient:    srv.Client(),
+		FetchUser:     true,
+		Prompter: func(context.Context, Prompt) error {
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal("RunFlow:", err)
+	}
+	if result.AccessToken != token {
+		t.Errorf("result.AccessToken = %q; want %q", result.AccessToken, token)
+	}
+	if want := "octocat"; result.Login != want {
+		t.Errorf("result.Login = %q; want %q", result.Login, want)
+	}
+}
+
+func TestFlowUnixSocket(t *testing.T) {
+	const token = "xyzzy"
+	socketPath := filepath.Join(t.TempDir(), "github.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Skip("Unix sockets not supported:", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/device/code", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, url.Values{
+			"device_code":      {"abc"},
+			"user_code":        {"DED-BEF"},
+			"verification_uri": {"https://github.com/login/device"},
+			"interval":         {"1"},
+		}.Encode())
+	})
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, url.Values{
+			"access_token": {token},
+			"token_type":   {"bearer"},
+		}.Encode())
+	})
+	mux.HandleFunc("/api/v3/user", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		io.WriteString(w, `{"login":"octocat","id":1}`)
+	})
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	t.Cleanup(client.CloseIdleConnections)
+	result, err := RunFlow(context.Background(), Options{
+		ClientID:      "cafe1234",
+		GitHubURL:     &url.URL{Scheme: "http", Host: "localhost"},
+		HTTPClient:    client,
+		FetchUser:     true,
+		AllowInsecure: true,
+		Prompter: func(context.Context, Prompt) error {
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal("RunFlow:", err)
+	}
+	if result.AccessToken != token {
+		t.Errorf("result.AccessToken = %q; want %q", result.AccessToken, token)
+	}
+	if want := "octocat"; result.Login != want {
+		t.Errorf("result.Login = %q; want %q", result.Login, want)
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+	const token = "xyzzy"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/user" {
+			http.NotFound(w, r)
+			return
+		}
+		if got, want := r.Header.Get("Authorization"), "token "+token; got != want {
+			http.Error(w, "Bad credentials", http.StatusUnauthorized)
+			return
+		}
+		if got, want := r.Header.Get("X-GitHub-Api-Version"), "2099-01-01"; got != want {
+			t.Errorf("X-GitHub-Api-Version = %q; want %q", got, want)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("X-OAuth-Scopes", "repo, read:org")
+		io.WriteString(w, `{"login":"octocat","id":1}`)
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		GitHubURL:     u,
+		AllowInsecure: true,
+		HTTPClient:    srv.Client(),
+		APIVersion:    "2099-01-01",
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		info, err := CheckToken(context.Background(), opts, token)
+		if err != nil {
+			t.Fatal("CheckToken:", err)
+		}
+		want := &TokenInfo{
+			Login:  "octocat",
+			Scopes: []string{"repo", "read:org"},
+		}
+		if diff := cmp.Diff(want, info); diff != "" {
+			t.Errorf("CheckToken(...) (-want +got):\n%s", diff)
+		}
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := CheckToken(context.Background(), opts, "plugh")
+		t.Log("CheckToken:", err)
+		if !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("errors.Is(err, ErrInvalidToken) = false; want true")
+		}
+	})
+	t.Run("HeaderVersion", func(t *testing.T) {
+		opts := opts.Clone()
+		opts.APIVersion = ""
+		opts.Header = http.Header{"X-Github-Api-Version": {"2099-01-01"}}
+		if _, err := CheckToken(context.Background(), opts, token); err != nil {
+			t.Error("CheckToken:", err)
+		}
+	})
+}
+
+func TestCheckTokens(t *testing.T) {
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+		time.Sleep(10 * time.Millisecond)
+		login := strings.TrimPrefix(r.Header.Get("Authorization"), "token user-")
+		if login == r.Header.Get("Authorization") {
+			http.Error(w, "Bad credentials", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("X-OAuth-Scopes", "repo")
+		fmt.Fprintf(w, `{"login":%q}`, login)
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		GitHubURL:     u,
+		HTTPClient:    srv.Client(),
+		AllowInsecure: true,
+	}
+
+	var tokens []string
+	for i := 0; i < 3*checkTokensConcurrency; i++ {
+		if i == 5 {
+			tokens = append(tokens, "revoked")
+			continue
+		}
+		tokens = append(tokens, fmt.Sprintf("user-%d", i))
+	}
+	infos, err := CheckTokens(context.Background(), opts, tokens)
+	t.Log("CheckTokens:", err)
+	var errs TokenErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("CheckTokens(...) error = %v; want TokenErrors", err)
+	}
+	if len(infos) != len(tokens) || len(errs) != len(tokens) {
+		t.Fatalf("CheckTokens(...) returned %d infos and %d errors; want %d", len(infos), len(errs), len(tokens))
+	}
+	for i := range tokens {
+		if i == 5 {
+			if infos[i] != nil || !errors.Is(errs[i], ErrInvalidToken) {
+				t.Errorf("token %d: info = %+v, err = %v; want nil, ErrInvalidToken", i, infos[i], errs[i])
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Errorf("token %d: %v", i, errs[i])
+			continue
+		}
+		if want := fmt.Sprint(i); infos[i].Login != want {
+			t.Errorf("token %d: Login = %q; want %q", i, infos[i].Login, want)
+		}
+	}
+	if maxActive > checkTokensConcurrency {
+		t.Errorf("%d concurrent requests; want at most %d", maxActive, checkTokensConcurrency)
+	}
+
+	t.Run("AllValid", func(t *testing.T) {
+		infos, err := CheckTokens(context.Background(), opts, []string{"user-a", "user-b"})
+		if err != nil {
+			t.Fatal("CheckTokens:", err)
+		}
+		if infos[0].Login != "a" || infos[1].Login != "b" {
+			t.Errorf("logins = %q, %q; want \"a\", \"b\"", infos[0].Login, infos[1].Login)
+		}
+	})
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := CheckTokens(ctx, opts, tokens)
+		var errs TokenErrors
+		if !errors.As(err, &errs) {
+			t.Fatalf("CheckTokens(...) error = %v; want TokenErrors", err)
+		}
+		for i, err := range errs {
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("token %d: err = %v; want context.Canceled", i, err)
+			}
+		}
+	})
+}
+
+func TestRevokeToken(t *testing.T) {
+	const (
+		clientID     = "cafe1234"
+		clientSecret = "s3cr3t"
+		token        = "xyzzy"
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete || r.URL.Path != "/api/v3/applications/"+clientID+"/token" {
+			t.Errorf("request = %s %s; want DELETE /api/v3/applications/%s/token", r.Method, r.URL.Path, clientID)
+			http.NotFound(w, r)
+			return
+		}
+		if user, pass, _ := r.BasicAuth(); user != clientID || pass != clientSecret {
+			http.Error(w, "Requires authentication", http.StatusUnauthorized)
+			return
+		}
+		var body struct {
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.AccessToken != token {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		ClientID:      clientID,
+		GitHubURL:     u,
+		AllowInsecure: true,
+		HTTPClient:    srv.Client(),
+	}
+
+	if err := RevokeToken(context.Background(), opts, clientSecret, token); err != nil {
+		t.Error("RevokeToken:", err)
+	}
+	if err := RevokeToken(context.Background(), opts, clientSecret, "plugh"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("RevokeToken(unknown token) = %v; want error matching ErrInvalidToken", err)
+	}
+	if err := RevokeToken(context.Background(), opts, "wrong", token); err == nil || errors.Is(err, ErrInvalidToken) {
+		t.Errorf("RevokeToken(wrong secret) = %v; want non-ErrInvalidToken error", err)
+	}
+}
+
+func TestAPIURL(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{
+			name: "Default",
+			want: "https://api.github.com/user",
+		},
+		{
+			name: "GitHubDotCom",
+			opts: Options{
+				GitHubURL: &url.URL{Scheme: "https", Host: "github.com"},
+			},
+			want: "https://api.github.com/user",
+		},
+		{
+			name: "GitHubDotComHTTP",
+			opts: Options{
+				GitHubURL: &url.URL{Scheme: "http", Host: "github.com"},
+			},
+			want: "http://api.github.com/user",
+		},
+		{
+			name: "Enterprise",
+			opts: Options{
+				GitHubURL: &url.URL{Scheme: "https", Host: "github.example.com"},
+			},
+			want: "https://github.example.com/api/v3/user",
+		},
+		{
+			name: "GitHubDotComPreset",
+			opts: GitHubDotCom(),
+			want: "https://api.github.com/user",
+		},
+		{
+			name: "EnterprisePreset",
+			opts: Enterprise("github.example.com:8443"),
+			want: "https://github.example.com:8443/api/v3/user",
+		},
+		{
+			name: "Explicit",
+			opts: Options{
+				GitHubURL: &url.URL{Scheme: "https", Host: "github.example.com"},
+				APIURL:    &url.URL{Scheme: "https", Host: "api.example.com", Path: "/v3/"},
+			},
+			want: "https://api.example.com/v3/user",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.opts.apiURL("/user").String(); got != test.want {
+				t.Errorf("apiURL(\"/user\") = %q; want %q", got, test.want)
+			}
+		})
+	}
+}
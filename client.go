@@ -0,0 +1,63 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice
+
+import (
+	"context"
+	"net/http"
+)
+
+// Client runs the device flow like Flow and returns an HTTP client that sends
+// the obtained access token with every request. The returned client can be
+// passed to API libraries like github.com/google/go-github.
+//
+// The client uses the Transport, CheckRedirect, Jar, and Timeout of
+// opts.HTTPClient (or http.DefaultClient). The token is not refreshed: if it
+// expires, the caller must run the flow again.
+func Client(ctx context.Context, opts Options) (*http.Client, error) {
+	token, err := Flow(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	opts, _ = opts.withTLSClient()
+	base := opts.client()
+	c := new(http.Client)
+	*c = *base
+	c.Transport = &tokenTransport{
+		token: token,
+		base:  base.Transport,
+	}
+	return c, nil
+}
+
+// tokenTransport is an http.RoundTripper that adds an Authorization header
+// with a Bearer token to every request.
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request, so make a copy.
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
@@ -0,0 +1,60 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gg-scm.io/pkg/ghdevice"
+	"gg-scm.io/pkg/ghdevice/ghdevicetest"
+)
+
+func TestClient(t *testing.T) {
+	flowServer := ghdevicetest.NewServer(ghdevicetest.Config{
+		Responses: []ghdevicetest.Response{ghdevicetest.Success("xyzzy")},
+	})
+	t.Cleanup(flowServer.Close)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("Authorization"), "Bearer xyzzy"; got != want {
+			t.Errorf("Authorization = %q; want %q", got, want)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(apiServer.Close)
+
+	opts := flowServer.Options()
+	opts.Prompter = func(context.Context, ghdevice.Prompt) error { return nil }
+	client, err := ghdevice.Client(context.Background(), opts)
+	if err != nil {
+		t.Fatal("Client:", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, apiServer.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := req.Header.Get("Authorization"); got != "" {
+		t.Errorf("Original request modified: Authorization = %q", got)
+	}
+}
@@ -19,62 +19,172 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"log"
 	"net/url"
 	"os"
+	"runtime/debug"
 	"strings"
 
 	"gg-scm.io/pkg/ghdevice"
 )
 
+// Exit codes that permit scripts to distinguish why ghtoken failed.
+const (
+	exitError   = 1
+	exitUsage   = 2
+	exitDenied  = 3
+	exitTimeout = 4
+)
+
+// defaultClientID is the client ID of the OAuth application for ghtoken.
+const defaultClientID = "52f432109560ca1046af"
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(runCheck(os.Args[2:]))
+		case "revoke":
+			os.Exit(runRevoke(os.Args[2:]))
+		}
+	}
 	flag.Usage = func() {
-		fmt.Fprint(flag.CommandLine.Output(), "usage: ghtoken [options]\n\n")
+		fmt.Fprint(flag.CommandLine.Output(), "usage: ghtoken [options]\n"+
+			"       ghtoken check [options] < TOKEN\n"+
+			"       ghtoken revoke [options] < TOKEN\n\n")
 		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nghtoken exits with status %d if the user denies authorization,\n"+
+			"%d if authorization times out, and %d on other errors.\n", exitDenied, exitTimeout, exitError)
 	}
-	opts := ghdevice.Options{
-		UserAgent: "gg-scm.io/pkg/ghdevice/cmd/ghtoken",
-		Prompter: func(ctx context.Context, p ghdevice.Prompt) error {
-			_, err := fmt.Fprintf(os.Stderr, "Go to %s and enter code %s\n", p.VerificationURL, p.UserCode)
-			return err
-		},
-		GitHubURL: &url.URL{
-			Scheme: "https",
-			Host:   "github.com",
-		},
-	}
-	flag.StringVar(&opts.ClientID, "client-id", "52f432109560ca1046af", "OAuth application client `ID`")
+	opts := baseOptions()
+	flag.StringVar(&opts.ClientID, "client-id", defaultClientID, "OAuth application client `ID`")
 	flag.Var((*stringSlice)(&opts.Scopes), "scope", "OAuth `scope`(s) to request. May be specified more than once or comma-separated.")
+	flag.Var(scopeFileFlag{&opts.Scopes}, "scope-file", "read OAuth scopes to request from `path`, one or more per line (comma-separated). Blank lines and lines starting with '#' are ignored.")
 	flag.Var(urlFlag{&opts.GitHubURL}, "url", "base `URL` for GitHub")
+	showVersion := flag.Bool("version", false, "print the version of ghtoken and exit")
+	verbose := flag.Bool("v", false, "print progress of the flow to stderr (never includes the token)")
+	noNewline := flag.Bool("n", false, "do not print a trailing newline after the token")
+	flag.BoolVar(noNewline, "no-newline", false, "same as -n")
+	store := flag.Bool("store", false, "save the token in git's credential store file for the GitHub host instead of printing it")
+	storeFile := flag.String("store-file", "", "credential store `path` for -store (default ~/.git-credentials)")
+	tokenFD := flag.Int("token-fd", -1, "write the token to the already-open file descriptor `N` instead of stdout, such as a pipe from a parent process")
+	lang := flag.String("lang", envLanguage(), "`language` of the instructions (one of "+strings.Join(languages(), ", ")+")")
 	flag.Parse()
 	if flag.NArg() != 0 {
 		flag.Usage()
-		os.Exit(2)
+		os.Exit(exitUsage)
+	}
+	tmpl, ok := promptTemplates[*lang]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "ghtoken: unsupported language %q\n", *lang)
+		os.Exit(exitUsage)
+	}
+	opts.Prompter = ghdevice.ConsolePrompter{W: os.Stderr, Template: tmpl}.Prompt
+	if *showVersion {
+		fmt.Println("ghtoken", version())
+		return
+	}
+	if *verbose {
+		opts.Logger = log.New(os.Stderr, "ghtoken: ", 0)
+	}
+	if *store && *tokenFD >= 0 {
+		fmt.Fprintln(os.Stderr, "ghtoken: -store and -token-fd cannot be used together")
+		os.Exit(exitUsage)
+	}
+	// Check the file descriptor before starting the flow
+	// so that the user is not asked to authorize for nothing.
+	out := os.Stdout
+	if *tokenFD >= 0 {
+		var err error
+		out, err = openTokenFD(*tokenFD)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ghtoken: -token-fd:", err)
+			os.Exit(exitUsage)
+		}
+	}
+	if *store && *storeFile == "" {
+		var err error
+		*storeFile, err = gitCredentialsPath()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ghtoken: store credential:", err)
+			os.Exit(exitError)
+		}
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	signals := make(chan os.Signal, 1)
-	setupSignals(signals)
-	go func() {
-		<-signals
-		cancel()
-	}()
-
+	ignoreSignals()
+	ctx, stop := ghdevice.SignalContext(context.Background())
 	token, err := ghdevice.Flow(ctx, opts)
-	cancel()
-	if err != nil {
+	stop()
+	switch {
+	case errors.Is(err, ghdevice.ErrAccessDenied):
+		fmt.Fprintln(os.Stderr, "ghtoken: Authorization was denied.")
+		os.Exit(exitDenied)
+	case errors.Is(err, ghdevice.ErrTimeout):
+		fmt.Fprintln(os.Stderr, "ghtoken:", err)
+		os.Exit(exitTimeout)
+	case errors.Is(err, ghdevice.ErrDeviceFlowDisabled):
+		fmt.Fprintf(os.Stderr, "ghtoken: The OAuth application with client ID %q does not have device flow enabled.\n"+
+			"ghtoken: Its owner must check \"Enable Device Flow\" in the application's settings on GitHub,\n"+
+			"ghtoken: or use -client-id with an application that has it enabled.\n", opts.ClientID)
+		os.Exit(exitError)
+	case errors.Is(err, ghdevice.ErrIncorrectClientCredentials):
+		// The default client ID doesn't work for everyone, such as users of
+		// GitHub Enterprise Server.
+		fmt.Fprintf(os.Stderr, "ghtoken: Client ID %q is not recognized by GitHub; check -client-id.\n", opts.ClientID)
+		os.Exit(exitError)
+	case err != nil:
 		fmt.Fprintln(os.Stderr, "ghtoken:", err)
-		os.Exit(1)
+		os.Exit(exitError)
+	}
+	if *store {
+		if err := storeCredential(*storeFile, opts.GitHubURL, token); err != nil {
+			fmt.Fprintln(os.Stderr, "ghtoken:", err)
+			os.Exit(exitError)
+		}
+		return
+	}
+	if !*noNewline {
+		token += "\n"
 	}
-	_, err = fmt.Println(token)
+	_, err = out.WriteString(token)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "ghtoken:", err)
-		os.Exit(1)
+		os.Exit(exitError)
+	}
+	if out != os.Stdout {
+		// Closing signals end of file to a reader on the other end of a pipe.
+		if err := out.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, "ghtoken:", err)
+			os.Exit(exitError)
+		}
 	}
 }
 
+// baseOptions returns the Options shared by all of ghtoken's modes.
+func baseOptions() ghdevice.Options {
+	return ghdevice.Options{
+		UserAgent: "ghtoken/" + version() + " (gg-scm.io/pkg/ghdevice/cmd/ghtoken)",
+		GitHubURL: &url.URL{
+			Scheme: "https",
+			Host:   "github.com",
+		},
+	}
+}
+
+// version returns the module version ghtoken was built from.
+func version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" {
+		return "(devel)"
+	}
+	return info.Main.Version
+}
+
 type urlFlag struct {
 	urlPtr **url.URL
 }
@@ -111,3 +221,33 @@ func (ss *stringSlice) Set(s string) error {
 	}
 	return nil
 }
+
+type scopeFileFlag struct {
+	scopes *[]string
+}
+
+func (sf scopeFileFlag) String() string {
+	return ""
+}
+
+func (sf scopeFileFlag) Set(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := (*stringSlice)(sf.scopes).Set(line); err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+	return nil
+}
@@ -19,13 +19,27 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"os/signal"
 
 	"golang.org/x/sys/unix"
 )
 
-func setupSignals(signals chan<- os.Signal) {
-	signal.Notify(signals, unix.SIGTERM, unix.SIGINT)
+// ignoreSignals ignores signals that should not stop ghtoken.
+func ignoreSignals() {
 	signal.Ignore(unix.SIGPIPE)
 }
+
+// openTokenFD returns the file for -token-fd after checking
+// that fd is open for writing.
+func openTokenFD(fd int) (*os.File, error) {
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+	if err != nil {
+		return nil, fmt.Errorf("file descriptor %d: %w", fd, err)
+	}
+	if mode := flags & unix.O_ACCMODE; mode != unix.O_WRONLY && mode != unix.O_RDWR {
+		return nil, fmt.Errorf("file descriptor %d is not open for writing", fd)
+	}
+	return os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd)), nil
+}
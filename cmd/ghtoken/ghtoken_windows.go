@@ -17,10 +17,23 @@
 package main
 
 import (
+	"fmt"
 	"os"
-	"os/signal"
 )
 
-func setupSignals(signals chan<- os.Signal) {
-	signal.Notify(signals, os.Interrupt)
+// ignoreSignals does nothing on Windows, which has no SIGPIPE.
+func ignoreSignals() {}
+
+// openTokenFD returns the file for -token-fd. On Windows, fd is a handle.
+// Windows has no cheap way to ask whether a handle is writable,
+// so only check that it is open: writing reports any other problem.
+func openTokenFD(fd int) (*os.File, error) {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+	if f == nil {
+		return nil, fmt.Errorf("file descriptor %d is not valid", fd)
+	}
+	if _, err := f.Stat(); err != nil {
+		return nil, fmt.Errorf("file descriptor %d: %w", fd, err)
+	}
+	return f, nil
 }
@@ -0,0 +1,63 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// promptTemplates maps language codes to the prompt shown to the user.
+// See ghdevice.ConsolePrompter for the template syntax.
+var promptTemplates = map[string]string{
+	"de": "Öffnen Sie {{.VerificationURL}} und geben Sie den Code {{.UserCode}} ein\n",
+	"en": "Go to {{.VerificationURL}} and enter code {{.UserCode}}\n",
+	"es": "Visite {{.VerificationURL}} e introduzca el código {{.UserCode}}\n",
+	"fr": "Ouvrez {{.VerificationURL}} et saisissez le code {{.UserCode}}\n",
+}
+
+// languages returns the supported language codes in sorted order.
+func languages() []string {
+	langs := make([]string, 0, len(promptTemplates))
+	for lang := range promptTemplates {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// envLanguage returns the user's preferred language from the POSIX locale
+// environment variables, or "en" if it is not supported.
+func envLanguage() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		locale := os.Getenv(name)
+		if locale == "" {
+			continue
+		}
+		// Locales look like "de_DE.UTF-8". Only the language is needed.
+		lang := locale
+		if i := strings.IndexAny(lang, "_.@"); i != -1 {
+			lang = lang[:i]
+		}
+		if _, ok := promptTemplates[lang]; ok {
+			return lang
+		}
+		break
+	}
+	return "en"
+}
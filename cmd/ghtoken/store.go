@@ -0,0 +1,127 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tokenPassword is the password that accompanies an OAuth token
+// in a credential store entry.
+const tokenPassword = "x-oauth-basic"
+
+// gitCredentialsPath returns the default path of git's credential store,
+// as used by "git credential-store".
+func gitCredentialsPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".git-credentials"), nil
+}
+
+// storeCredential records token for the host of u in the git credential store
+// file at path. GitHub accepts an OAuth token as the username with
+// "x-oauth-basic" as the password. An existing token entry for the host is
+// replaced so that git does not find a stale token first; all other lines are
+// kept. If path is a symlink, its target is updated. The file is replaced
+// atomically and is only readable by the current user.
+func storeCredential(path string, u *url.URL, token string) error {
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("store credential: URL %q has no scheme or host", u)
+	}
+	switch target, err := filepath.EvalSymlinks(path); {
+	case err == nil:
+		path = target
+	case !os.IsNotExist(err):
+		return fmt.Errorf("store credential: %w", err)
+	default:
+		// Don't replace a dangling symlink with a regular file.
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("store credential: %s is a broken symlink", path)
+		}
+	}
+	entry := (&url.URL{
+		Scheme: u.Scheme,
+		User:   url.UserPassword(token, tokenPassword),
+		Host:   u.Host,
+	}).String()
+	old, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("store credential: %w", err)
+	}
+	newData := new(bytes.Buffer)
+	s := bufio.NewScanner(bytes.NewReader(old))
+	for s.Scan() {
+		line := s.Text()
+		if isTokenCredential(line, u) {
+			continue
+		}
+		newData.WriteString(line)
+		newData.WriteString("\n")
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("store credential: %s: %w", path, err)
+	}
+	newData.WriteString(entry)
+	newData.WriteString("\n")
+
+	// ioutil.TempFile creates the file with mode 0600.
+	f, err := ioutil.TempFile(filepath.Dir(path), ".git-credentials*")
+	if err != nil {
+		return fmt.Errorf("store credential: %w", err)
+	}
+	_, writeErr := f.Write(newData.Bytes())
+	closeErr := f.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(f.Name(), path)
+	}
+	if writeErr != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("store credential: %w", writeErr)
+	}
+	return nil
+}
+
+// isTokenCredential reports whether line is a credential store entry
+// for the scheme and host of u that holds an OAuth token,
+// like the ones storeCredential writes.
+func isTokenCredential(line string, u *url.URL) bool {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return false
+	}
+	entry, err := url.Parse(line)
+	if err != nil {
+		return false
+	}
+	password, _ := entry.User.Password()
+	return password == tokenPassword &&
+		strings.EqualFold(entry.Scheme, u.Scheme) &&
+		strings.EqualFold(entry.Host, u.Host) &&
+		strings.Trim(entry.Path, "/") == ""
+}
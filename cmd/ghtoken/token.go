@@ -0,0 +1,163 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gg-scm.io/pkg/ghdevice"
+)
+
+// Tokens are read from stdin or a file rather than from command-line
+// arguments, since arguments are visible to other users in process listings.
+// ghtoken never prints the token it reads.
+
+// maxTokenSize is the largest token file ghtoken will read.
+const maxTokenSize = 64 << 10
+
+// runCheck implements "ghtoken check", which prints the owner and scopes of
+// an access token.
+func runCheck(args []string) int {
+	fset := flag.NewFlagSet("ghtoken check", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprint(fset.Output(), "usage: ghtoken check [options] < TOKEN\n\n"+
+			"Print the user and scopes of a GitHub access token read from stdin.\n\n")
+		fset.PrintDefaults()
+	}
+	opts := baseOptions()
+	fset.Var(urlFlag{&opts.GitHubURL}, "url", "base `URL` for GitHub")
+	tokenFile := fset.String("token-file", "", "read the token from `path` instead of stdin")
+	fset.Parse(args)
+	if fset.NArg() != 0 {
+		fset.Usage()
+		return exitUsage
+	}
+	token, err := readToken(*tokenFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ghtoken:", err)
+		return exitError
+	}
+	ctx, stop := ghdevice.SignalContext(context.Background())
+	defer stop()
+	info, err := ghdevice.CheckToken(ctx, opts, token)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ghtoken:", err)
+		return exitError
+	}
+	fmt.Printf("login: %s\nscopes: %s\n", info.Login, strings.Join(info.Scopes, ", "))
+	return 0
+}
+
+// runRevoke implements "ghtoken revoke", which revokes an access token.
+func runRevoke(args []string) int {
+	fset := flag.NewFlagSet("ghtoken revoke", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprint(fset.Output(), "usage: ghtoken revoke -client-secret-file PATH [options] < TOKEN\n\n"+
+			"Revoke a GitHub access token read from stdin.\n"+
+			"GitHub requires the OAuth application's client secret to revoke tokens.\n\n")
+		fset.PrintDefaults()
+	}
+	opts := baseOptions()
+	fset.StringVar(&opts.ClientID, "client-id", defaultClientID, "OAuth application client `ID`")
+	fset.Var(urlFlag{&opts.GitHubURL}, "url", "base `URL` for GitHub")
+	tokenFile := fset.String("token-file", "", "read the token from `path` instead of stdin")
+	secretFile := fset.String("client-secret-file", "", "read the OAuth application's client secret from `path`")
+	fset.Parse(args)
+	if fset.NArg() != 0 || *secretFile == "" {
+		fset.Usage()
+		return exitUsage
+	}
+	secret, err := readSecretFile(*secretFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ghtoken: client secret:", err)
+		return exitError
+	}
+	token, err := readToken(*tokenFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ghtoken:", err)
+		return exitError
+	}
+	ctx, stop := ghdevice.SignalContext(context.Background())
+	defer stop()
+	if err := ghdevice.RevokeToken(ctx, opts, secret, token); err != nil {
+		fmt.Fprintln(os.Stderr, "ghtoken:", err)
+		return exitError
+	}
+	return 0
+}
+
+// readToken reads an access token from the file at path or from stdin if
+// path is empty or "-". It refuses to read from a terminal, where the token
+// would be echoed as it is typed.
+func readToken(path string) (string, error) {
+	if path != "" && path != "-" {
+		token, err := readSecretFile(path)
+		if err != nil {
+			return "", fmt.Errorf("read token: %w", err)
+		}
+		return token, nil
+	}
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return "", errors.New("read token: refusing to read from a terminal, which would echo it; pipe the token to ghtoken or use -token-file")
+	}
+	token, err := readSecret(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("read token: stdin: %w", err)
+	}
+	return token, nil
+}
+
+// readSecretFile reads a single-line secret from the file at path.
+func readSecretFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	secret, err := readSecret(f)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	return secret, nil
+}
+
+// readSecret reads a single-line secret from r,
+// ignoring surrounding whitespace.
+func readSecret(r io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxTokenSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxTokenSize {
+		return "", errors.New("too large")
+	}
+	secret := strings.TrimSpace(string(data))
+	switch {
+	case secret == "":
+		return "", errors.New("empty")
+	case strings.ContainsAny(secret, " \t\r\n"):
+		return "", errors.New("must be a single line without spaces")
+	}
+	return secret, nil
+}
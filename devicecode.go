@@ -0,0 +1,282 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DeviceCode is a device code issued by GitHub. Most programs should use Flow,
+// but RequestDeviceCode, PollToken, and PollOnce permit a program to run the
+// steps of the device flow itself.
+type DeviceCode struct {
+	// DeviceCode is the code used to poll for the access token.
+	DeviceCode string
+	// UserCode is the code the user should enter into the GitHub webpage.
+	UserCode string
+	// VerificationURL is the URL of the webpage the user should enter their code in.
+	VerificationURL string
+	// VerificationURLComplete is a URL that includes the user code.
+	// It is empty if the server does not provide one.
+	VerificationURLComplete string
+	// ExpiresAt is the time at which the device code expires.
+	ExpiresAt time.Time
+	// Interval is the minimum amount of time to wait between polls.
+	Interval time.Duration
+	// Response holds every field of the server's device code response,
+	// including non-standard ones. It is nil for a DeviceCode that was not
+	// returned by RequestDeviceCode or Flow.
+	Response url.Values
+}
+
+// Prompt returns the information to show the user for the device code.
+func (dc *DeviceCode) Prompt() Prompt {
+	return Prompt{
+		VerificationURL:         dc.VerificationURL,
+		VerificationURLComplete: dc.VerificationURLComplete,
+		UserCode:                dc.UserCode,
+		RawUserCode:             dc.UserCode,
+		ExpiresIn:               time.Until(dc.ExpiresAt),
+		ExpiresAt:               dc.ExpiresAt,
+		Response:                redactDeviceCodeResponse(dc.Response),
+	}
+}
+
+// redactDeviceCodeResponse returns a copy of resp without the device code,
+// which the user does not need to see.
+func redactDeviceCodeResponse(resp url.Values) url.Values {
+	if resp == nil {
+		return nil
+	}
+	redacted := make(url.Values, len(resp))
+	for k, v := range resp {
+		redacted[k] = append([]string(nil), v...)
+	}
+	delete(redacted, "device_code")
+	return redacted
+}
+
+// validate reports an error if dc is missing a field needed for polling.
+func (dc *DeviceCode) validate() error {
+	switch {
+	case dc == nil:
+		return errors.New("device code not provided")
+	case dc.DeviceCode == "":
+		return errors.New("device code is empty")
+	case dc.ExpiresAt.IsZero():
+		return errors.New("device code has no expiration time")
+	case dc.Interval <= 0:
+		return fmt.Errorf("device code has invalid polling interval %v", dc.Interval)
+	}
+	return nil
+}
+
+// RequestDeviceCode requests a new device code from GitHub. The caller is
+// responsible for presenting the code to the user and then polling for the
+// access token with PollToken or PollOnce. opts.Prompter is ignored.
+func RequestDeviceCode(ctx context.Context, opts Options) (*DeviceCode, error) {
+	if opts.clientID() == "" {
+		return nil, fmt.Errorf("github authorization flow: client ID not provided")
+	}
+	if opts.StrictScopes {
+		if err := checkScopes(opts.Scopes); err != nil {
+			return nil, fmt.Errorf("github authorization flow: %w", err)
+		}
+	}
+	opts, done := opts.withTLSClient()
+	defer done()
+	dc, err := requestDeviceCode(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("github authorization flow: %w", err)
+	}
+	return dc, nil
+}
+
+// CheckDeviceFlowEnabled reports whether the OAuth application identified by
+// opts.ClientID (or opts.ClientIDByHost) has the device flow enabled, so that
+// a program can report a misconfigured application before prompting the user.
+// GitHub offers no other way to tell, so CheckDeviceFlowEnabled requests a
+// device code and discards it; the unused code expires on its own.
+//
+// If the device flow is disabled, the returned error is an *OAuthError with
+// the code "device_flow_disabled" and matches ErrDeviceFlowDisabled when
+// tested with errors.Is. Other errors mean that the check could not be made.
+// opts.Scopes and opts.Prompter are ignored.
+func CheckDeviceFlowEnabled(ctx context.Context, opts Options) error {
+	if opts.clientID() == "" {
+		return fmt.Errorf("github authorization flow: client ID not provided")
+	}
+	opts.Scopes = nil
+	opts, done := opts.withTLSClient()
+	defer done()
+	_, err := requestDeviceCode(ctx, opts)
+	var oauthErr *OAuthError
+	if errors.As(err, &oauthErr) && errors.Is(oauthErr, ErrDeviceFlowDisabled) {
+		return fmt.Errorf("github authorization flow: client ID %q: %w", opts.clientID(), oauthErr)
+	}
+	if err != nil {
+		return fmt.Errorf("github authorization flow: %w", err)
+	}
+	return nil
+}
+
+func requestDeviceCode(ctx context.Context, opts Options) (*DeviceCode, error) {
+	codeData, err := post(ctx, opts, opts.deviceCodeURL(), DeviceCodeForm(opts), opts.DeviceCodeFormat)
+	if isTimeout(err) {
+		return nil, fmt.Errorf("get device code: could not reach GitHub: %w", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get device code: %w", err)
+	}
+	if codeData.Get("verification_uri") == "" && codeData.Get("verification_url") != "" {
+		// Older servers, including some GitHub Enterprise versions,
+		// use the name from a draft of RFC 8628.
+		codeData.Set("verification_uri", codeData.Get("verification_url"))
+	}
+	var missing []string
+	for _, k := range []string{"device_code", "user_code", "verification_uri"} {
+		if codeData.Get(k) == "" {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("get device code: response is missing %s", strings.Join(missing, ", "))
+	}
+	expiry := parseSeconds(codeData.Get("expires_in"), 15*time.Minute)
+	return &DeviceCode{
+		DeviceCode:              codeData.Get("device_code"),
+		UserCode:                codeData.Get("user_code"),
+		VerificationURL:         codeData.Get("verification_uri"),
+		VerificationURLComplete: codeData.Get("verification_uri_complete"),
+		ExpiresAt:               time.Now().Add(expiry),
+		Interval:                parseSeconds(codeData.Get("interval"), 5*time.Second),
+		Response:                codeData,
+	}, nil
+}
+
+// PollToken polls GitHub at the device code's interval until the user
+// authorizes the application, the device code expires, the Context is done,
+// or an unrecoverable error occurs. On success, PollToken returns a GitHub
+// Bearer access token. If the device code expires, the returned error wraps
+// context.DeadlineExceeded and the caller should request a new device code.
+//
+// dc does not need to come from RequestDeviceCode: a program may construct
+// it from a code obtained elsewhere, such as in another process. Its
+// DeviceCode, ExpiresAt, and Interval fields must be set.
+//
+// Polling can be paused by canceling ctx and resumed by calling PollToken
+// again with the same dc, as long as dc.ExpiresAt has not passed: the polling
+// deadline is always computed from dc.ExpiresAt. If GitHub asks the caller to
+// slow down, PollToken stores the new interval in dc.Interval so that resumed
+// polling honors it.
+func PollToken(ctx context.Context, opts Options, dc *DeviceCode) (string, error) {
+	if opts.clientID() == "" {
+		return "", fmt.Errorf("github authorization flow: client ID not provided")
+	}
+	if err := dc.validate(); err != nil {
+		return "", fmt.Errorf("github authorization flow: %w", err)
+	}
+	opts, done := opts.withTLSClient()
+	defer done()
+	pollCtx, cancelPoll := context.WithDeadline(ctx, dc.ExpiresAt)
+	defer cancelPoll()
+	var polls int
+	interval := dc.Interval
+	resp, err := waitForAccessToken(pollCtx, opts, dc.DeviceCode, &interval, &polls, nil)
+	dc.Interval = interval
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("github authorization flow: %w", doneError(ctx))
+		}
+		return "", fmt.Errorf("github authorization flow: %w", err)
+	}
+	return resp.Get("access_token"), nil
+}
+
+// PollOnce makes a single access token request for the device code.
+// It is intended for programs that schedule polls themselves: the caller must
+// wait at least dc.Interval between calls.
+//
+// On success, PollOnce returns the access token. If the user has not yet
+// entered the code, PollOnce returns pending=true and a nil error. If GitHub
+// asks the caller to poll less frequently, PollOnce returns an *OAuthError with
+// the code "slow_down": the caller should increase its interval to the error's
+// RetryAfter, if set, and continue polling. Any other error is terminal for
+// the device code.
+//
+// If GitHub's response includes an updated polling interval, even on a pending
+// or successful poll, PollOnce stores it in dc.Interval.
+func PollOnce(ctx context.Context, opts Options, dc *DeviceCode) (token string, pending bool, err error) {
+	if opts.clientID() == "" {
+		return "", false, fmt.Errorf("github authorization flow: client ID not provided")
+	}
+	if err := dc.validate(); err != nil {
+		return "", false, fmt.Errorf("github authorization flow: %w", err)
+	}
+	opts, done := opts.withTLSClient()
+	defer done()
+	resp, err := post(ctx, opts, opts.tokenURL(), TokenForm(opts, dc.DeviceCode), opts.TokenFormat)
+	if oauthErr := (*OAuthError)(nil); errors.As(err, &oauthErr) {
+		if oauthErr.RetryAfter > 0 {
+			dc.Interval = oauthErr.RetryAfter
+		}
+		if oauthErr.Code == "authorization_pending" {
+			return "", true, nil
+		}
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("github authorization flow: get access token: %w", err)
+	}
+	if interval := parseSeconds(resp.Get("interval"), 0); interval > 0 {
+		dc.Interval = interval
+	}
+	token = resp.Get("access_token")
+	if token == "" {
+		return "", false, fmt.Errorf("github authorization flow: get access token: server did not return an access token")
+	}
+	return token, false, nil
+}
+
+// DeviceCodeForm returns the values that Flow and RequestDeviceCode send to
+// the device code endpoint for opts, for programs that must inspect, sign, or
+// log requests before they are forwarded. With FormatJSON, the same values are
+// sent as a JSON object.
+func DeviceCodeForm(opts Options) url.Values {
+	params := url.Values{
+		"client_id": {opts.clientID()},
+		"scope":     {strings.Join(normalizeScopes(opts.Scopes), " ")},
+	}
+	if opts.LoginHint != "" {
+		params.Set("login", opts.LoginHint)
+	}
+	return params
+}
+
+// TokenForm returns the values that Flow, PollToken, and PollOnce send to the
+// access token endpoint for the given device code. See DeviceCodeForm.
+func TokenForm(opts Options, deviceCode string) url.Values {
+	return url.Values{
+		"client_id":   {opts.clientID()},
+		"device_code": {deviceCode},
+		"grant_type":  {opts.grantType()},
+	}
+}
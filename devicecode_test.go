@@ -0,0 +1,593 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPollOnce(t *testing.T) {
+	ctx := context.Background()
+	responses := []string{
+		"error=authorization_pending",
+		"error=slow_down&interval=10",
+		"access_token=xyzzy&token_type=bearer",
+	}
+	var progress struct {
+		mu sync.Mutex
+		n  int
+	}
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		progress.mu.Lock()
+		resp := responses[progress.n]
+		if progress.n+1 < len(responses) {
+			progress.n++
+		}
+		progress.mu.Unlock()
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, resp)
+	})
+
+	start := time.Now()
+	dc, err := RequestDeviceCode(ctx, opts)
+	if err != nil {
+		t.Fatal("RequestDeviceCode:", err)
+	}
+	if dc.UserCode != "DED-BEF" {
+		t.Errorf("dc.UserCode = %q; want \"DED-BEF\"", dc.UserCode)
+	}
+	if dc.Interval != time.Second {
+		t.Errorf("dc.Interval = %v; want 1s", dc.Interval)
+	}
+	if wantMin := start.Add(900 * time.Second); dc.ExpiresAt.Before(wantMin) {
+		t.Errorf("dc.ExpiresAt = %v; want after %v", dc.ExpiresAt, wantMin)
+	}
+
+	token, pending, err := PollOnce(ctx, opts, dc)
+	if token != "" || !pending || err != nil {
+		t.Fatalf("PollOnce #1 = %q, %t, %v; want \"\", true, <nil>", token, pending, err)
+	}
+	token, pending, err = PollOnce(ctx, opts, dc)
+	var oauthErr *OAuthError
+	if !errors.As(err, &oauthErr) || oauthErr.Code != "slow_down" {
+		t.Fatalf("PollOnce #2 = %q, %t, %v; want slow_down error", token, pending, err)
+	}
+	if oauthErr.RetryAfter != 10*time.Second {
+		t.Errorf("PollOnce #2 error RetryAfter = %v; want 10s", oauthErr.RetryAfter)
+	}
+	token, pending, err = PollOnce(ctx, opts, dc)
+	if token != "xyzzy" || pending || err != nil {
+		t.Fatalf("PollOnce #3 = %q, %t, %v; want \"xyzzy\", false, <nil>", token, pending, err)
+	}
+}
+
+func TestPollOnceInterval(t *testing.T) {
+	ctx := context.Background()
+	responses := []string{
+		"error=authorization_pending&interval=7",
+		"access_token=xyzzy&token_type=bearer&interval=3",
+	}
+	var progress struct {
+		mu sync.Mutex
+		n  int
+	}
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		progress.mu.Lock()
+		resp := responses[progress.n]
+		if progress.n+1 < len(responses) {
+			progress.n++
+		}
+		progress.mu.Unlock()
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, resp)
+	})
+	dc, err := RequestDeviceCode(ctx, opts)
+	if err != nil {
+		t.Fatal("RequestDeviceCode:", err)
+	}
+
+	if _, pending, err := PollOnce(ctx, opts, dc); !pending || err != nil {
+		t.Fatalf("PollOnce #1 = _, %t, %v; want _, true, <nil>", pending, err)
+	}
+	if dc.Interval != 7*time.Second {
+		t.Errorf("after pending poll, dc.Interval = %v; want 7s", dc.Interval)
+	}
+	if token, _, err := PollOnce(ctx, opts, dc); token != "xyzzy" || err != nil {
+		t.Fatalf("PollOnce #2 = %q, _, %v; want \"xyzzy\", _, <nil>", token, err)
+	}
+	if dc.Interval != 3*time.Second {
+		t.Errorf("after successful poll, dc.Interval = %v; want 3s", dc.Interval)
+	}
+}
+
+func TestPollToken(t *testing.T) {
+	ctx := context.Background()
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+	})
+	dc, err := RequestDeviceCode(ctx, opts)
+	if err != nil {
+		t.Fatal("RequestDeviceCode:", err)
+	}
+	token, err := PollToken(ctx, opts, dc)
+	if token != "xyzzy" || err != nil {
+		t.Errorf("PollToken(...) = %q, %v; want \"xyzzy\", <nil>", token, err)
+	}
+}
+
+func TestPollTokenWithDeviceCode(t *testing.T) {
+	ctx := context.Background()
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", formMediaType)
+		if got := r.PostForm.Get("device_code"); got != "elsewhere" {
+			io.WriteString(w, "error=incorrect_device_code")
+			return
+		}
+		io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+	})
+	dc := &DeviceCode{
+		DeviceCode: "elsewhere",
+		ExpiresAt:  time.Now().Add(time.Minute),
+		Interval:   10 * time.Millisecond,
+	}
+	token, err := PollToken(ctx, opts, dc)
+	if token != "xyzzy" || err != nil {
+		t.Errorf("PollToken(...) = %q, %v; want \"xyzzy\", <nil>", token, err)
+	}
+
+	invalid := []*DeviceCode{
+		nil,
+		{ExpiresAt: dc.ExpiresAt, Interval: dc.Interval},
+		{DeviceCode: dc.DeviceCode, Interval: dc.Interval},
+		{DeviceCode: dc.DeviceCode, ExpiresAt: dc.ExpiresAt},
+	}
+	for _, dc := range invalid {
+		if token, err := PollToken(ctx, opts, dc); err == nil {
+			t.Errorf("PollToken(ctx, opts, %+v) = %q, <nil>; want error", dc, token)
+		}
+		if token, _, err := PollOnce(ctx, opts, dc); err == nil {
+			t.Errorf("PollOnce(ctx, opts, %+v) = %q, _, <nil>; want error", dc, token)
+		}
+	}
+}
+
+func TestPollTokenResume(t *testing.T) {
+	var state struct {
+		mu         sync.Mutex
+		slowedDown bool
+		authorized bool
+	}
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		w.Header().Set("Content-Type", formMediaType)
+		switch {
+		case !state.slowedDown:
+			state.slowedDown = true
+			io.WriteString(w, "error=slow_down&interval=1")
+		case !state.authorized:
+			io.WriteString(w, "error=authorization_pending")
+		default:
+			io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+		}
+	})
+	expiresAt := time.Now().Add(time.Minute)
+	dc := &DeviceCode{
+		DeviceCode: "xyzzy",
+		ExpiresAt:  expiresAt,
+		Interval:   10 * time.Millisecond,
+	}
+
+	// Pause polling after GitHub asks to slow down.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	token, err := PollToken(ctx, opts, dc)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("PollToken(paused) = %q, %v; want error matching ErrTimeout", token, err)
+	}
+	if dc.Interval != time.Second {
+		t.Errorf("after slow_down, dc.Interval = %v; want 1s", dc.Interval)
+	}
+	if !dc.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("dc.ExpiresAt = %v; want %v", dc.ExpiresAt, expiresAt)
+	}
+
+	// Resume with the same device code.
+	state.mu.Lock()
+	state.authorized = true
+	state.mu.Unlock()
+	token, err = PollToken(context.Background(), opts, dc)
+	if token != "xyzzy" || err != nil {
+		t.Errorf("PollToken(resumed) = %q, %v; want \"xyzzy\", <nil>", token, err)
+	}
+
+	// A code that has expired can't be resumed.
+	expired := &DeviceCode{
+		DeviceCode: "xyzzy",
+		ExpiresAt:  time.Now().Add(-time.Second),
+		Interval:   10 * time.Millisecond,
+	}
+	if token, err := PollToken(context.Background(), opts, expired); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("PollToken(expired) = %q, %v; want error matching context.DeadlineExceeded", token, err)
+	}
+}
+
+func TestRequestForms(t *testing.T) {
+	var got struct {
+		mu         sync.Mutex
+		deviceCode url.Values
+		token      url.Values
+	}
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		got.mu.Lock()
+		got.token = r.PostForm
+		got.mu.Unlock()
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+	})
+	opts.Scopes = []string{"repo", "read:org"}
+	opts.LoginHint = "octocat"
+	// Wrap the transport like a signing gateway would to see the device code request.
+	base := opts.HTTPClient.Transport
+	opts.HTTPClient = &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if strings.HasSuffix(req.URL.Path, "/login/device/code") {
+				body, err := ioutil.ReadAll(req.Body)
+				if err != nil {
+					return nil, err
+				}
+				form, err := url.ParseQuery(string(body))
+				if err != nil {
+					return nil, err
+				}
+				got.mu.Lock()
+				got.deviceCode = form
+				got.mu.Unlock()
+				req = req.Clone(req.Context())
+				req.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+			}
+			return base.RoundTrip(req)
+		}),
+	}
+	if _, err := Flow(context.Background(), opts); err != nil {
+		t.Fatal("Flow:", err)
+	}
+	got.mu.Lock()
+	defer got.mu.Unlock()
+	if diff := cmp.Diff(DeviceCodeForm(opts), got.deviceCode); diff != "" {
+		t.Errorf("device code request (-DeviceCodeForm +got):\n%s", diff)
+	}
+	want := TokenForm(opts, "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx")
+	if diff := cmp.Diff(want, got.token); diff != "" {
+		t.Errorf("access token request (-TokenForm +got):\n%s", diff)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRequestDeviceCodeLoginHint(t *testing.T) {
+	for _, loginHint := range []string{"", "octocat"} {
+		var got []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := r.ParseForm(); err != nil {
+				t.Error(err)
+			}
+			got = r.PostForm["login"]
+			w.Header().Set("Content-Type", formMediaType)
+			io.WriteString(w, "device_code=xyzzy&user_code=DED-BEF&verification_uri=https%3A%2F%2Fexample.com%2Flogin%2Fdevice")
+		}))
+		t.Cleanup(srv.Close)
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := Options{
+			ClientID:      "cafe1234",
+			GitHubURL:     u,
+			AllowInsecure: true,
+			HTTPClient:    srv.Client(),
+			LoginHint:     loginHint,
+		}
+		if _, err := RequestDeviceCode(context.Background(), opts); err != nil {
+			t.Errorf("LoginHint=%q: RequestDeviceCode: %v", loginHint, err)
+			continue
+		}
+		var want []string
+		if loginHint != "" {
+			want = []string{loginHint}
+		}
+		if !cmp.Equal(want, got) {
+			t.Errorf("LoginHint=%q: login = %q; want %q", loginHint, got, want)
+		}
+	}
+}
+
+func TestDeviceCodePromptResponse(t *testing.T) {
+	dc := &DeviceCode{
+		DeviceCode:      "xyzzy",
+		UserCode:        "DED-BEF",
+		VerificationURL: "https://example.com/login/device",
+		Response: url.Values{
+			"device_code": {"xyzzy"},
+			"user_code":   {"DED-BEF"},
+			"message":     {"Enter the code on your TV"},
+		},
+	}
+	want := url.Values{
+		"user_code": {"DED-BEF"},
+		"message":   {"Enter the code on your TV"},
+	}
+	if diff := cmp.Diff(want, dc.Prompt().Response); diff != "" {
+		t.Errorf("dc.Prompt().Response (-want +got):\n%s", diff)
+	}
+	if dc.Response.Get("device_code") != "xyzzy" {
+		t.Error("dc.Prompt() modified dc.Response")
+	}
+	if got := (&DeviceCode{}).Prompt().Response; got != nil {
+		t.Errorf("Prompt().Response = %v for DeviceCode without a response; want nil", got)
+	}
+}
+
+func TestRequestDeviceCodeVerificationURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, "device_code=xyzzy&user_code=DED-BEF&verification_url=https%3A%2F%2Fexample.com%2Flogin%2Fdevice")
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err := RequestDeviceCode(context.Background(), Options{
+		ClientID:      "cafe1234",
+		GitHubURL:     u,
+		AllowInsecure: true,
+		HTTPClient:    srv.Client(),
+	})
+	if err != nil {
+		t.Fatal("RequestDeviceCode:", err)
+	}
+	if want := "https://example.com/login/device"; dc.VerificationURL != want {
+		t.Errorf("dc.VerificationURL = %q; want %q", dc.VerificationURL, want)
+	}
+}
+
+func TestDeviceCodeTimeout(t *testing.T) {
+	t.Parallel()
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hang until the client gives up. The server only notices the client
+		// disconnecting once the request body has been read.
+		io.Copy(ioutil.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	t.Cleanup(srv.Close)
+	// Cleanups run in reverse order, so this unblocks handlers before Close.
+	t.Cleanup(func() { close(stop) })
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newOptions := func() Options {
+		return Options{
+			ClientID:      "cafe1234",
+			GitHubURL:     u,
+			AllowInsecure: true,
+			HTTPClient:    srv.Client(),
+			Prompter: func(context.Context, Prompt) error {
+				t.Error("Prompter called")
+				return nil
+			},
+		}
+	}
+
+	t.Run("RequestTimeout", func(t *testing.T) {
+		t.Parallel()
+		opts := newOptions()
+		opts.RequestTimeout = 200 * time.Millisecond
+		_, err := Flow(context.Background(), opts)
+		t.Log("Flow:", err)
+		if err == nil || !strings.Contains(err.Error(), "could not reach GitHub") {
+			t.Error("error does not say GitHub could not be reached")
+		}
+	})
+
+	t.Run("ContextDeadline", func(t *testing.T) {
+		t.Parallel()
+		opts := newOptions()
+		opts.RequestTimeout = -1
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := Flow(ctx, opts)
+		t.Log("Flow:", err)
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("Flow took %v to return", elapsed)
+		}
+		if err == nil || !strings.Contains(err.Error(), "could not reach GitHub") {
+			t.Error("error does not say GitHub could not be reached")
+		}
+		if !errors.Is(err, ErrTimeout) {
+			t.Error("errors.Is(err, ErrTimeout) = false; want true")
+		}
+	})
+}
+
+func TestCheckDeviceFlowEnabled(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		content  string
+		disabled bool
+		wantErr  bool
+	}{
+		{
+			name:    "Enabled",
+			status:  http.StatusOK,
+			content: "device_code=xyzzy&user_code=DED-BEF&verification_uri=https%3A%2F%2Fexample.com%2Flogin%2Fdevice",
+		},
+		{
+			name:     "Disabled",
+			status:   http.StatusOK,
+			content:  "error=device_flow_disabled&error_description=Device+Flow+must+be+explicitly+enabled+for+this+App",
+			disabled: true,
+			wantErr:  true,
+		},
+		{
+			name:     "DisabledStatus400",
+			status:   http.StatusBadRequest,
+			content:  "error=device_flow_disabled",
+			disabled: true,
+			wantErr:  true,
+		},
+		{
+			name:    "IncorrectClientCredentials",
+			status:  http.StatusOK,
+			content: "error=incorrect_client_credentials",
+			wantErr: true,
+		},
+		{
+			name:    "ServerError",
+			status:  http.StatusInternalServerError,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/login/device/code" {
+					t.Errorf("request to %s; want /login/device/code", r.URL.Path)
+				}
+				if err := r.ParseForm(); err != nil {
+					t.Error(err)
+				}
+				if got := r.PostForm.Get("scope"); got != "" {
+					t.Errorf("scope = %q; want empty", got)
+				}
+				w.Header().Set("Content-Type", formMediaType)
+				w.WriteHeader(test.status)
+				io.WriteString(w, test.content)
+			}))
+			t.Cleanup(srv.Close)
+			u, err := url.Parse(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = CheckDeviceFlowEnabled(context.Background(), Options{
+				ClientID:      "cafe1234",
+				Scopes:        []string{"repo"},
+				GitHubURL:     u,
+				AllowInsecure: true,
+				HTTPClient:    srv.Client(),
+			})
+			t.Log("CheckDeviceFlowEnabled:", err)
+			if (err != nil) != test.wantErr {
+				t.Errorf("error = %v; want error = %t", err, test.wantErr)
+			}
+			if got := errors.Is(err, ErrDeviceFlowDisabled); got != test.disabled {
+				t.Errorf("errors.Is(err, ErrDeviceFlowDisabled) = %t; want %t", got, test.disabled)
+			}
+			var oauthErr *OAuthError
+			if test.disabled && (!errors.As(err, &oauthErr) || oauthErr.Code != "device_flow_disabled") {
+				t.Errorf("error is not an *OAuthError with code device_flow_disabled")
+			}
+			if test.disabled && !strings.Contains(err.Error(), `"cafe1234"`) {
+				t.Errorf("error does not mention client ID")
+			}
+		})
+	}
+}
+
+func TestRequestDeviceCodeMissingFields(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		content     string
+		want        string
+	}{
+		{
+			name: "Empty",
+			want: "device_code, user_code, verification_uri",
+		},
+		{
+			name:        "NoUserCode",
+			contentType: formMediaType,
+			content:     "device_code=xyzzy&verification_uri=https%3A%2F%2Fexample.com%2Flogin%2Fdevice",
+			want:        "user_code",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.contentType != "" {
+					w.Header().Set("Content-Type", test.contentType)
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(test.content)))
+				io.WriteString(w, test.content)
+			}))
+			t.Cleanup(srv.Close)
+			u, err := url.Parse(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := Options{
+				ClientID:      "cafe1234",
+				GitHubURL:     u,
+				AllowInsecure: true,
+				HTTPClient:    srv.Client(),
+				Prompter: func(context.Context, Prompt) error {
+					t.Error("Prompter called")
+					return nil
+				},
+			}
+			_, err = Flow(context.Background(), opts)
+			t.Log("Flow:", err)
+			if err == nil || !strings.Contains(err.Error(), "missing "+test.want) {
+				t.Errorf("error does not report missing %s", test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice
+
+import (
+	"fmt"
+	"time"
+)
+
+// EventType identifies a state transition in the device flow.
+type EventType int
+
+// Event types.
+const (
+	// DeviceCodeReceived is sent after GitHub issues a device code.
+	// Event.Prompt is set.
+	DeviceCodeReceived EventType = 1 + iota
+	// PromptShown is sent after the prompter returns successfully.
+	// Event.Prompt is set.
+	PromptShown
+	// Polled is sent after each access token request.
+	Polled
+	// SlowDown is sent when GitHub asks the flow to poll less frequently.
+	// Event.Interval is the new polling interval.
+	SlowDown
+	// Reprompt is sent when the flow abandons a device code
+	// to request a new one.
+	Reprompt
+	// Succeeded is sent when the flow obtains an access token.
+	Succeeded
+	// Failed is sent when the flow stops with an error.
+	// Event.Err is set.
+	Failed
+)
+
+var eventTypeNames = [...]string{
+	DeviceCodeReceived: "DeviceCodeReceived",
+	PromptShown:        "PromptShown",
+	Polled:             "Polled",
+	SlowDown:           "SlowDown",
+	Reprompt:           "Reprompt",
+	Succeeded:          "Succeeded",
+	Failed:             "Failed",
+}
+
+// String returns the name of the event type, like "PromptShown".
+func (typ EventType) String() string {
+	if typ <= 0 || int(typ) >= len(eventTypeNames) {
+		return fmt.Sprintf("EventType(%d)", int(typ))
+	}
+	return eventTypeNames[typ]
+}
+
+// Event describes a state transition in the device flow.
+// Events never include the access token.
+type Event struct {
+	Type EventType
+	// Prompt is the prompt for the current device code.
+	// It is set for DeviceCodeReceived and PromptShown events.
+	Prompt Prompt
+	// Interval is the polling interval requested by a SlowDown event.
+	Interval time.Duration
+	// Err is the error that caused a Failed event.
+	Err error
+}
+
+// String returns a human-readable description of the event.
+func (ev Event) String() string {
+	switch ev.Type {
+	case DeviceCodeReceived:
+		return "received device code: " + ev.Prompt.String()
+	case PromptShown:
+		return "prompted user; waiting for authorization"
+	case Polled:
+		return "polled for access token"
+	case SlowDown:
+		return fmt.Sprintf("asked to slow down; polling every %v", ev.Interval)
+	case Reprompt:
+		return "device code expired or abandoned; requesting a new one"
+	case Succeeded:
+		return "obtained access token"
+	case Failed:
+		return fmt.Sprintf("failed: %v", ev.Err)
+	default:
+		return ev.Type.String()
+	}
+}
+
+// emit logs an event to opts.Logger and sends it on opts.Events without
+// blocking.
+func (opts Options) emit(ev Event) {
+	opts.logf("%v", ev)
+	if opts.Events == nil {
+		return
+	}
+	select {
+	case opts.Events <- ev:
+	default:
+	}
+}
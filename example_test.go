@@ -44,15 +44,11 @@ func ExampleFlow() {
 		ClientID: "replacewithactualclientid",
 		// Change these to use the appropriate OAuth scopes for
 		// your application.
-		Scopes: []string{"public_repo", "read:user"},
+		Scopes: []string{ghdevice.ScopePublicRepo, ghdevice.ScopeReadUser},
 
 		// Prompter is a function to display login instructions to the user.
-		Prompter: func(ctx context.Context, p ghdevice.Prompt) error {
-			fmt.Fprintf(os.Stderr, "Visit %s in your browser and enter the code %s\n",
-				p.VerificationURL, p.UserCode)
-			fmt.Fprintf(os.Stderr, "Waiting...\n")
-			return nil
-		},
+		// StderrPrompter writes them to stderr.
+		Prompter: ghdevice.StderrPrompter().Prompt,
 	})
 	if err != nil {
 		// Handle error. For example:
@@ -74,3 +70,37 @@ func ExampleFlow() {
 	}
 	_ = repos
 }
+
+func ExampleClient() {
+	// Cancelling or adding a deadline to the context will interrupt the flow.
+	ctx := context.Background()
+
+	// Run the device flow and get an *http.Client that sends the
+	// access token with every request.
+	httpClient, err := ghdevice.Client(ctx, ghdevice.Options{
+		UserAgent: "myapplicationname",
+		ClientID:  "replacewithactualclientid",
+		Scopes:    []string{ghdevice.ScopePublicRepo, ghdevice.ScopeReadUser},
+		Prompter: func(ctx context.Context, p ghdevice.Prompt) error {
+			fmt.Fprintf(os.Stderr, "Visit %s in your browser and enter the code %s\n",
+				p.VerificationURL, p.UserCode)
+			return nil
+		},
+	})
+	if err != nil {
+		// Handle error. For example:
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+
+	// Use the client to make GitHub API requests.
+	ghClient := github.NewClient(httpClient)
+	ghClient.UserAgent = "myapplicationname"
+	repos, _, err := ghClient.Repositories.List(ctx, "", nil)
+	if err != nil {
+		// Handle error. For example:
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	_ = repos
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// A Format is an encoding for requests to and responses from GitHub's OAuth
+// endpoints. GitHub accepts and returns both form-encoded and JSON bodies.
+type Format int
+
+// Formats understood by the flow.
+const (
+	// FormatDefault uses the package's default format, currently FormatForm.
+	// The default may change to FormatJSON in a future release, so programs
+	// that depend on form encoding should request FormatForm explicitly.
+	FormatDefault Format = iota
+	// FormatForm sends and requests application/x-www-form-urlencoded bodies.
+	FormatForm
+	// FormatJSON sends and requests application/json bodies.
+	FormatJSON
+)
+
+// defaultFormat is the format used for FormatDefault.
+const defaultFormat = FormatForm
+
+const jsonMediaType = "application/json"
+
+// String returns a short name for the format, like "form" or "JSON".
+func (f Format) String() string {
+	switch f.resolve() {
+	case FormatForm:
+		return "form"
+	case FormatJSON:
+		return "JSON"
+	default:
+		return "Format(" + strconv.Itoa(int(f)) + ")"
+	}
+}
+
+// resolve returns the concrete format that f stands for.
+func (f Format) resolve() Format {
+	if f == FormatDefault {
+		return defaultFormat
+	}
+	return f
+}
+
+// mediaType returns the MIME type for the format.
+func (f Format) mediaType() string {
+	if f.resolve() == FormatJSON {
+		return jsonMediaType
+	}
+	return formMediaType
+}
+
+// encode returns the request body for form in the format.
+// JSON bodies are objects that map each key to its first value.
+func (f Format) encode(form url.Values) ([]byte, error) {
+	if f.resolve() != FormatJSON {
+		return []byte(form.Encode()), nil
+	}
+	obj := make(map[string]string, len(form))
+	for k := range form {
+		obj[k] = form.Get(k)
+	}
+	return json.Marshal(obj)
+}
+
+// parseJSONValues parses a JSON object into url.Values. Strings, numbers, and
+// booleans are converted to their string forms; other values are ignored.
+func parseJSONValues(data []byte) (url.Values, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, fmt.Errorf("response is not a JSON object")
+	}
+	v := make(url.Values, len(obj))
+	for k, x := range obj {
+		switch x := x.(type) {
+		case string:
+			v.Set(k, x)
+		case json.Number:
+			v.Set(k, x.String())
+		case bool:
+			v.Set(k, strconv.FormatBool(x))
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFlowFormats(t *testing.T) {
+	// checkRequest reports an error if r was not sent in the given media type.
+	checkRequest := func(r *http.Request, mediaType string) {
+		t.Helper()
+		if got, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); got != mediaType {
+			t.Errorf("%s Content-Type = %q; want %q", r.URL.Path, got, mediaType)
+		}
+		if got := r.Header.Get("Accept"); got != mediaType {
+			t.Errorf("%s Accept = %q; want %q", r.URL.Path, got, mediaType)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/device/code", func(w http.ResponseWriter, r *http.Request) {
+		checkRequest(r, jsonMediaType)
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error("Decode device code request:", err)
+		} else if body["client_id"] != "cafe1234" {
+			t.Errorf("device code request client_id = %q; want \"cafe1234\"", body["client_id"])
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		io.WriteString(w, `{"device_code":"xyzzy","user_code":"DED-BEF",`+
+			`"verification_uri":"https://example.com/login/device",`+
+			`"expires_in":900,"interval":1}`)
+	})
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		checkRequest(r, formMediaType)
+		if err := r.ParseForm(); err != nil {
+			t.Error("Parse access token request:", err)
+		} else if got := r.PostForm.Get("device_code"); got != "xyzzy" {
+			t.Errorf("access token request device_code = %q; want \"xyzzy\"", got)
+		}
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, "access_token=plugh&token_type=bearer")
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Prompt
+	token, err := Flow(context.Background(), Options{
+		ClientID:      "cafe1234",
+		GitHubURL:     u,
+		AllowInsecure: true,
+		HTTPClient:    srv.Client(),
+		Prompter: func(_ context.Context, p Prompt) error {
+			got = p
+			return nil
+		},
+		DeviceCodeFormat: FormatJSON,
+		TokenFormat:      FormatForm,
+	})
+	if err != nil {
+		t.Fatal("Flow:", err)
+	}
+	if token != "plugh" {
+		t.Errorf("token = %q; want \"plugh\"", token)
+	}
+	if got.UserCode != "DED-BEF" || got.VerificationURL != "https://example.com/login/device" {
+		t.Errorf("prompt = %+v; want user code \"DED-BEF\" at https://example.com/login/device", got)
+	}
+}
+
+func TestParseJSONValues(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    url.Values
+		wantErr bool
+	}{
+		{
+			data: `{"access_token":"xyzzy","expires_in":28800,"interval":5.5,"ok":true,"scopes":["repo"],"x":null}`,
+			want: url.Values{
+				"access_token": {"xyzzy"},
+				"expires_in":   {"28800"},
+				"interval":     {"5.5"},
+				"ok":           {"true"},
+			},
+		},
+		{data: `{}`, want: url.Values{}},
+		{data: `null`, wantErr: true},
+		{data: `["error"]`, wantErr: true},
+		{data: `error=slow_down`, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseJSONValues([]byte(test.data))
+		if err != nil {
+			if !test.wantErr {
+				t.Errorf("parseJSONValues(%q): %v", test.data, err)
+			}
+			continue
+		}
+		if test.wantErr {
+			t.Errorf("parseJSONValues(%q) = %v, <nil>; want error", test.data, got)
+			continue
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("parseJSONValues(%q) (-want +got):\n%s", test.data, diff)
+		}
+	}
+}
+
+func TestFormatDefault(t *testing.T) {
+	if got, want := FormatDefault.mediaType(), FormatForm.mediaType(); got != want {
+		t.Errorf("FormatDefault.mediaType() = %q; want %q", got, want)
+	}
+	if got := FormatJSON.String(); got != "JSON" {
+		t.Errorf("FormatJSON.String() = %q; want \"JSON\"", got)
+	}
+}
@@ -27,50 +27,429 @@
 package ghdevice
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"regexp"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 )
 
 // Options holds arguments for Flow.
 type Options struct {
-	// ClientID is the GitHub OAuth application client ID. It is required.
+	// ClientID is the GitHub OAuth application client ID. It is required
+	// unless ClientIDByHost has an entry for the host of GitHubURL.
 	// See https://docs.github.com/en/free-pro-team@latest/developers/apps/creating-an-oauth-app
 	// for instructions on how to create an OAuth application.
 	ClientID string
 
+	// ClientIDByHost maps hosts, like "github.example.com", to the client IDs
+	// to use for them, for programs that authorize against several GitHub
+	// instances with different OAuth applications. If the host of GitHubURL
+	// is not in the map, ClientID is used.
+	ClientIDByHost map[string]string
+
 	// Prompter is a function called to inform the user of the URL to visit and
 	// enter in a code. It may be called more than once if the user doesn't enter
-	// the code in a timely manner. If the function returns an error, Flow returns
-	// the error, wrapped with additional detail.
+	// the code in a timely manner. If the function returns ErrNewCode, Flow
+	// abandons the code and calls Prompter again with a new one. If the function
+	// returns any other error, Flow returns the error, wrapped with additional
+	// detail, unless PromptRetries permits another attempt.
+	//
+	// Flow does not start polling GitHub until Prompter returns, so Prompter
+	// may block until the user acknowledges the prompt (for example, by
+	// clicking a button after authorizing the application) to avoid spending
+	// requests before the user has seen the code. The Context passed to
+	// Prompter is done when the code expires: if Prompter returns an error
+	// after the code expired, Flow prompts again with a new code.
+	//
+	// To use a value that implements the Prompter interface, pass its Prompt
+	// method, like ConsolePrompter{W: os.Stderr}.Prompt.
 	Prompter func(context.Context, Prompt) error
 
+	// PromptRetries is the number of times Flow calls Prompter again with the
+	// same code after it returns an error other than ErrNewCode, for prompters
+	// with transient failures like a browser that fails to open. Once the
+	// retries are spent, the error ends the flow. If it is zero, any error
+	// from Prompter ends the flow.
+	PromptRetries int
+
+	// UserCodeFormatter, if not nil, is applied to the user code before it is
+	// set in Prompt.UserCode, for example to space out the characters for
+	// display. Prompt.RawUserCode holds the unformatted code.
+	UserCodeFormatter func(userCode string) string
+
 	// Scopes specifies the OAuth scopes to request for the token.
 	// See https://docs.github.com/en/free-pro-team@latest/developers/apps/scopes-for-oauth-apps
 	// for scope names. If empty, then only public information can be accessed.
+	// Surrounding whitespace, empty scopes, and duplicates are ignored.
 	Scopes []string
 
+	// DryRun makes Flow stop after the first prompt is shown, without polling
+	// for an access token, and return an error that matches ErrDryRun. It is
+	// intended for developing and testing prompters.
+	DryRun bool
+
+	// StrictScopes makes Flow check that each of Scopes is one of the
+	// documented GitHub OAuth scopes (the Scope constants) and return an
+	// error listing the unknown scopes before making any requests. It is
+	// useful for catching typos like "read:users", which GitHub ignores.
+	StrictScopes bool
+
+	// LoginHint is sent as the "login" parameter of the device code request
+	// to suggest the account to authorize. Support is provider-dependent:
+	// GitHub does not document the parameter for the device flow, so servers
+	// that don't recognize it will ignore it.
+	LoginHint string
+
+	// GrantType is the grant_type parameter of access token requests.
+	// If it is empty or only whitespace, DefaultGrantType is used. Only set
+	// it for servers that require a non-standard value, like "device_code".
+	GrantType string
+
 	// HTTPClient specifies the client to make HTTP requests from.
-	// If it is nil, http.DefaultClient is used.
+	// If it is nil, http.DefaultClient is used. The client's Transport is used
+	// as-is, so a client with a custom Transport can be used for GitHub
+	// Enterprise Server deployments that require mutual TLS or a proxy.
+	// If the client has a Timeout, it applies to each request, not to the
+	// flow as a whole: a poll that times out is retried at the next interval.
+	// Use the Context passed to Flow to bound the whole flow.
 	HTTPClient *http.Client
 
+	// TLSClientConfig is a convenience for configuring TLS without providing
+	// an HTTPClient, like when a GitHub Enterprise Server deployment uses a
+	// private certificate authority or requires client certificates. If it is
+	// not nil and HTTPClient is nil, then requests are made with a copy of
+	// http.DefaultTransport that uses this TLS configuration. It is ignored
+	// if HTTPClient is not nil.
+	TLSClientConfig *tls.Config
+
 	// GitHubURL is the root URL used for the login endpoints.
 	// If it is nil, defaults to "https://github.com".
+	//
+	// GitHubURL is only used to build request URLs, so it need not name a TCP
+	// host. To reach GitHub through a proxy listening on a Unix socket, use
+	// an HTTPClient whose Transport's DialContext dials the socket and a
+	// GitHubURL like "http://localhost" with AllowInsecure set.
 	GitHubURL *url.URL
 
+	// APIURL is the root URL of the GitHub REST API. It is only used by
+	// operations that call the API, like FetchUser. If it is nil, it is derived
+	// from GitHubURL: "https://api.github.com" for github.com and
+	// GitHubURL + "/api/v3" for GitHub Enterprise Server.
+	APIURL *url.URL
+
+	// APIVersion is the GitHub REST API version to request in the
+	// X-GitHub-Api-Version header of API calls, like those made by FetchUser,
+	// CheckToken, and RevokeToken. The header is not sent to the OAuth
+	// endpoints. If it is empty, the version in Header is used, if any, or
+	// else DefaultAPIVersion.
+	APIVersion string
+
+	// FetchUser specifies whether RunFlow should look up the login of the user
+	// that authorized the application after obtaining the access token.
+	// This costs an additional API request.
+	FetchUser bool
+
+	// DeviceCodePath and TokenPath are the paths of the device code and access
+	// token endpoints, relative to GitHubURL. If empty, they default to GitHub's
+	// "/login/device/code" and "/login/oauth/access_token", respectively.
+	// Together with GitHubURL, these permit authorizing against other forges
+	// that implement the same device flow, like a self-hosted Gitea instance.
+	DeviceCodePath string
+	TokenPath      string
+
+	// DeviceCodeFormat and TokenFormat are the encodings used for requests to
+	// the device code and access token endpoints and the encodings asked for
+	// in their responses. Responses in either format are accepted. The zero
+	// value, FormatDefault, currently means FormatForm.
+	DeviceCodeFormat Format
+	TokenFormat      Format
+
+	// Events receives an Event for each state transition in the flow, which
+	// permits a user interface to display the flow's progress. If it is nil,
+	// no events are sent. Flow never blocks on sending an event: if the
+	// channel is not ready to receive, the event is dropped.
+	Events chan<- Event
+
+	// OnReprompt is called when a device code expires before the user
+	// authorizes the application, just before Flow requests a new code.
+	// previous is the prompt for the expired code. It is intended for
+	// instrumentation, like measuring how often codes expire; use Prompter
+	// to show the new code. It is not called when Prompter returns ErrNewCode.
+	OnReprompt func(ctx context.Context, previous Prompt)
+
+	// OnDeviceCode is called with each device code after Flow obtains it and
+	// before Flow calls Prompter, which permits a program to persist the code
+	// so that it can resume polling with PollToken if it exits after
+	// prompting. If OnDeviceCode returns an error, Flow stops and returns it.
+	OnDeviceCode func(ctx context.Context, dc DeviceCode) error
+
+	// OnToken is called with the flow's result right after Flow obtains an
+	// access token and before Flow returns, which permits a program to
+	// persist or validate the token as part of the flow. If OnToken returns
+	// an error, Flow returns it.
+	//
+	// GitHub has already issued the token when OnToken is called, so a token
+	// may exist even if OnToken fails or the program exits before it returns.
+	// When OnToken fails, RunFlow's result still holds the token so that the
+	// caller can revoke it with RevokeToken.
+	OnToken func(ctx context.Context, result FlowResult) error
+
+	// RequestTimeout is the maximum amount of time to wait for each HTTP
+	// request to GitHub, independent of the deadline of the Context passed
+	// to Flow. A poll that times out is retried at the next interval.
+	// If it is zero, defaults to 30 seconds. If it is negative, requests are
+	// only bounded by the Context.
+	//
+	// Each request's Context is derived from the Context passed to Flow, so
+	// deadlines layer predictably: HTTPClient's Transport (or middleware
+	// wrapping it) may apply a shorter deadline to a single request, and the
+	// earliest of the flow's deadline, RequestTimeout, and the Transport's
+	// deadline wins. A poll that times out for any of these reasons while
+	// the device code is still valid is retried at the next interval.
+	RequestTimeout time.Duration
+
+	// Deadline, if not zero, is the time by which Flow must finish, including
+	// any new device codes and prompts. It is combined with the deadline of
+	// the Context passed to Flow (and the timeout of FlowWithTimeout, which
+	// sets that deadline), and the earliest one wins. When Deadline passes,
+	// Flow returns an error that matches ErrTimeout, like it does for a
+	// Context deadline. Deadline does not shorten RequestTimeout for requests
+	// made well before it.
+	Deadline time.Time
+
+	// MaxInterval caps how far the polling interval can grow when GitHub asks
+	// the flow to slow down. It never shortens the device code's initial
+	// interval, which is the minimum GitHub allows between polls. If it is
+	// zero, the interval is not capped.
+	MaxInterval time.Duration
+
+	// InitialDelay is the minimum amount of time Flow waits after prompting
+	// before it first polls for the access token, which gives the user time to
+	// enter the code instead of spending a request on a response that
+	// authorization is pending. Flow never polls sooner than the device code's
+	// interval, so a delay shorter than the interval has no effect. It applies
+	// to each device code.
+	InitialDelay time.Duration
+
+	// PendingBackoff, if positive, makes the flow double its polling interval
+	// after that many consecutive "authorization_pending" responses, up to
+	// MaxInterval, to reduce load while waiting a long time for the user.
+	// This deviates from the fixed-interval polling that the device flow
+	// specifies, so it is off by default. It has no effect unless MaxInterval
+	// is set. Requests to slow down are honored regardless.
+	PendingBackoff int
+
+	// MaxPolls is the maximum number of access token requests made during the
+	// flow, across all device codes. Once it is reached, the flow fails with
+	// an error that matches ErrTooManyPolls. If it is zero, the number of polls
+	// is not limited.
+	MaxPolls int
+
+	// Logger receives diagnostic messages, like each state transition of the
+	// flow and warnings that GitHub has deprecated an endpoint used by this
+	// package. Messages never include the access token. If it is nil, then
+	// messages are discarded.
+	Logger Logger
+
+	// Semaphore limits the number of concurrent flows that share it, such as
+	// flows started on behalf of many users with the same HTTPClient. Flow
+	// sends a value on the channel before making its first request and
+	// receives a value when it returns, so the channel's capacity is the
+	// maximum number of flows in progress. If it is nil, then the number of
+	// concurrent flows is not limited.
+	Semaphore chan struct{}
+
+	// Metrics receives counts of flow outcomes, like the number of flows
+	// that succeeded, for monitoring. If it is nil, then no metrics are
+	// recorded.
+	Metrics Metrics
+
 	// UserAgent is the User-Agent header sent to the GitHub API.
-	// If it is empty, a generic header is used.
+	// If it is empty, a generic header that identifies this package
+	// (like "ghdevice/v0.1.0") is used.
 	// See https://docs.github.com/en/free-pro-team@latest/rest/overview/resources-in-the-rest-api#user-agent-required
 	// for guidance on acceptable values.
 	UserAgent string
+
+	// Header holds additional headers to send with every request, like
+	// X-GitHub-Api-Version. Headers that this package sets itself, like
+	// Content-Type, Accept, Authorization, and User-Agent, take precedence.
+	Header http.Header
+
+	// LenientContentType makes the flow parse a 200 or 400 response that is
+	// missing a Content-Type header in the format it asked for: form-encoded,
+	// unless DeviceCodeFormat or TokenFormat says otherwise. GitHub always
+	// sends the header, so this is off by default, but some proxies and
+	// compatible servers strip it.
+	LenientContentType bool
+
+	// NoRedirects makes requests to the device code and access token endpoints
+	// fail with an error matching ErrRedirect if the server responds with a
+	// redirect. GitHub does not redirect these endpoints. Even if NoRedirects
+	// is false, redirects to a different scheme or host are always refused,
+	// since following them could send the device code to an unexpected server.
+	NoRedirects bool
+
+	// AllowInsecure permits requests over plain HTTP to loopback hosts, like
+	// "http://127.0.0.1:8080" or "http://localhost", for tests and local
+	// proxies. It should not be set otherwise. Requests over plain HTTP to any
+	// other host are always refused, since they would expose the device code
+	// and access token to the network.
+	AllowInsecure bool
+
+	// Transcript, if not nil, receives a record of each exchange with the
+	// device code and access token endpoints: the method, URL, request
+	// fields, response status, and response fields. Access tokens, refresh
+	// tokens, and device codes are redacted, so a transcript can be attached
+	// to a bug report. Each record is written with a single call to Write.
+	Transcript io.Writer
+}
+
+// Logger is the interface used to report diagnostic messages.
+// *log.Logger satisfies this interface.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+func (opts Options) logf(format string, args ...interface{}) {
+	if opts.Logger != nil {
+		opts.Logger.Printf(format, args...)
+	}
+}
+
+// GitHubDotCom returns Options with GitHubURL and APIURL set for github.com.
+// The caller must still set fields like ClientID and Prompter.
+func GitHubDotCom() Options {
+	return Options{
+		GitHubURL: &url.URL{Scheme: "https", Host: "github.com"},
+		APIURL:    &url.URL{Scheme: "https", Host: "api.github.com"},
+	}
+}
+
+// Enterprise returns Options with GitHubURL and APIURL set for the GitHub
+// Enterprise Server at the given host, like "github.example.com": the web
+// interface at https://host and the API at https://host/api/v3. The caller
+// must still set fields like ClientID and Prompter.
+func Enterprise(host string) Options {
+	return Options{
+		GitHubURL: &url.URL{Scheme: "https", Host: host},
+		APIURL:    &url.URL{Scheme: "https", Host: host, Path: "/api/v3"},
+	}
+}
+
+// Clone returns a deep copy of opts. Modifying the Scopes, GitHubURL,
+// APIURL, Header, or ClientIDByHost of the returned Options does not affect
+// opts, and vice versa.
+func (opts Options) Clone() Options {
+	opts.Scopes = append([]string(nil), opts.Scopes...)
+	if opts.ClientIDByHost != nil {
+		m := make(map[string]string, len(opts.ClientIDByHost))
+		for host, id := range opts.ClientIDByHost {
+			m[host] = id
+		}
+		opts.ClientIDByHost = m
+	}
+	opts.GitHubURL = cloneURL(opts.GitHubURL)
+	opts.APIURL = cloneURL(opts.APIURL)
+	opts.Header = opts.Header.Clone()
+	return opts
+}
+
+func cloneURL(u *url.URL) *url.URL {
+	if u == nil {
+		return nil
+	}
+	u2 := new(url.URL)
+	*u2 = *u
+	return u2
+}
+
+// clientID returns the client ID for the host of opts.GitHubURL.
+func (opts Options) clientID() string {
+	if id := opts.ClientIDByHost[opts.url("/").Host]; id != "" {
+		return id
+	}
+	return opts.ClientID
+}
+
+const defaultRequestTimeout = 30 * time.Second
+
+func (opts Options) requestTimeout() time.Duration {
+	if opts.RequestTimeout == 0 {
+		return defaultRequestTimeout
+	}
+	return opts.RequestTimeout
+}
+
+// DefaultGrantType is the grant type defined for the device flow
+// in RFC 8628 Section 3.4.
+const DefaultGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+func (opts Options) grantType() string {
+	if gt := strings.TrimSpace(opts.GrantType); gt != "" {
+		return gt
+	}
+	return DefaultGrantType
+}
+
+// backoffInterval returns the interval to use after opts.PendingBackoff
+// consecutive pending responses: double the current interval, clamped like
+// slowDownInterval. The result is never shorter than current.
+func (opts Options) backoffInterval(initial, current time.Duration) time.Duration {
+	if opts.PendingBackoff <= 0 || opts.MaxInterval <= 0 {
+		return current
+	}
+	next := opts.slowDownInterval(initial, 2*current)
+	if next < current {
+		return current
+	}
+	return next
+}
+
+// slowDownInterval returns the interval requested by a slow_down response,
+// clamped to opts.MaxInterval or the device code's initial interval,
+// whichever is larger.
+func (opts Options) slowDownInterval(initial, requested time.Duration) time.Duration {
+	if opts.MaxInterval <= 0 {
+		return requested
+	}
+	limit := opts.MaxInterval
+	if limit < initial {
+		limit = initial
+	}
+	if requested > limit {
+		return limit
+	}
+	return requested
+}
+
+// withTLSClient returns a copy of opts with HTTPClient set to a client that
+// uses opts.TLSClientConfig, if needed. The returned function releases the
+// client's resources and must be called when the caller is done with the
+// returned Options.
+func (opts Options) withTLSClient() (_ Options, done func()) {
+	if opts.HTTPClient != nil || opts.TLSClientConfig == nil {
+		return opts, func() {}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = opts.TLSClientConfig
+	opts.HTTPClient = &http.Client{Transport: transport}
+	return opts, transport.CloseIdleConnections
 }
 
 func (opts Options) client() *http.Client {
@@ -80,7 +459,57 @@ func (opts Options) client() *http.Client {
 	return opts.HTTPClient
 }
 
+// ErrRedirect indicates that an OAuth endpoint redirected the flow to another
+// location that the flow refused to follow. See Options.NoRedirects.
+var ErrRedirect = errors.New("refused to follow redirect")
+
+// postClient returns the HTTP client to use for requests to the OAuth
+// endpoints: opts.client() with a redirect policy that refuses redirects to a
+// different scheme or host, or any redirect if opts.NoRedirects is set.
+func (opts Options) postClient() *http.Client {
+	base := opts.client()
+	c := new(http.Client)
+	*c = *base
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		orig := via[0].URL
+		switch {
+		case opts.NoRedirects:
+			return fmt.Errorf("redirected to %v: %w", req.URL, ErrRedirect)
+		case req.URL.Scheme != orig.Scheme || req.URL.Host != orig.Host:
+			return fmt.Errorf("redirected to %v, a different host: %w", req.URL, ErrRedirect)
+		case base.CheckRedirect != nil:
+			return base.CheckRedirect(req, via)
+		case len(via) >= 10:
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return c
+}
+
+const (
+	defaultDeviceCodePath = "/login/device/code"
+	defaultTokenPath      = "/login/oauth/access_token"
+)
+
+func (opts Options) deviceCodeURL() *url.URL {
+	if opts.DeviceCodePath == "" {
+		return opts.url(defaultDeviceCodePath)
+	}
+	return opts.url(opts.DeviceCodePath)
+}
+
+func (opts Options) tokenURL() *url.URL {
+	if opts.TokenPath == "" {
+		return opts.url(defaultTokenPath)
+	}
+	return opts.url(opts.TokenPath)
+}
+
 func (opts Options) url(path string) *url.URL {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
 	if opts.GitHubURL == nil {
 		return &url.URL{
 			Scheme: "https",
@@ -94,13 +523,198 @@ func (opts Options) url(path string) *url.URL {
 	return u
 }
 
+// checkURL returns an error if opts do not permit sending a request to u.
+func (opts Options) checkURL(u *url.URL) error {
+	if !strings.EqualFold(u.Scheme, "http") {
+		return nil
+	}
+	if !opts.AllowInsecure {
+		return fmt.Errorf("refusing to send request to %v over plain http (use https)", u)
+	}
+	if !isLoopback(u.Hostname()) {
+		return fmt.Errorf("refusing to send request to %v over plain http: AllowInsecure only permits loopback hosts", u)
+	}
+	return nil
+}
+
+// isLoopback reports whether host names the local machine.
+func isLoopback(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// RequestIDKey is a context key. It can be used with context.WithValue to
+// attach a correlation ID to the HTTP requests made during the flow. The
+// associated value will be of type string. WithRequestID is a convenient way
+// to set it.
+var RequestIDKey = &contextKey{"request-id"}
+
+// RequestIDHeader is the HTTP header used to send the request ID
+// set by WithRequestID.
+const RequestIDHeader = "X-Request-Id"
+
+// WithRequestID returns a copy of ctx that carries the given correlation ID.
+// Every HTTP request made with the returned Context will include the ID in
+// its RequestIDHeader header, so that the requests can be traced through
+// proxy and server logs.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, RequestIDKey, id)
+}
+
+// RequestIDFromContext returns the correlation ID set by WithRequestID
+// or the empty string if ctx does not carry one.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(RequestIDKey).(string)
+	return id
+}
+
+// contextKey is a value for use with context.WithValue. It's used as a pointer
+// so it fits in an interface{} without allocation.
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string {
+	return "ghdevice context value " + k.name
+}
+
+// ErrNewCode can be returned by a prompter to abandon the device code it was
+// given. Instead of failing, Flow will request a new device code
+// and prompt the user again.
+var ErrNewCode = errors.New("new device code requested")
+
 // Prompt holds the information shown to prompt the user to enter a code in
 // their web browser.
 type Prompt struct {
 	// VerificationURL is the URL of the webpage the user should enter their code in.
 	VerificationURL string
-	// UserCode is the code the user should enter into the GitHub webpage.
+	// VerificationURLComplete is a URL that includes the user code, so the
+	// user does not need to type it, like for a QR code. It is empty if the
+	// server does not provide one. GitHub does not, at the time of writing.
+	VerificationURLComplete string
+	// UserCode is the code the user should enter into the GitHub webpage,
+	// as formatted by Options.UserCodeFormatter.
 	UserCode string
+	// RawUserCode is the user code as returned by GitHub,
+	// before Options.UserCodeFormatter was applied.
+	RawUserCode string
+	// ExpiresIn is how long the code was valid for when the prompt was created.
+	ExpiresIn time.Duration
+	// ExpiresAt is the time at which the code expires. It does not change
+	// while the prompt is displayed, so it is suitable for a countdown.
+	ExpiresAt time.Time
+	// Response holds the fields of the device code response other than the
+	// device code itself, so that a prompter can show non-standard fields,
+	// like a message, sent by some servers. Its contents depend on the server.
+	// It may be nil.
+	Response url.Values
+}
+
+// String returns a one-line description of the prompt,
+// like "enter DED-BEF at https://github.com/login/device".
+func (p Prompt) String() string {
+	return "enter " + p.UserCode + " at " + p.VerificationURL
+}
+
+// FlowResult holds the outcome of a device flow run by RunFlow.
+type FlowResult struct {
+	// AccessToken is the GitHub Bearer access token.
+	// It is empty if no token was obtained.
+	AccessToken string
+	// TokenType is the type of the access token, usually "bearer".
+	TokenType string
+	// Scopes are the scopes GitHub granted to the token, which may differ
+	// from the scopes requested.
+	Scopes Scopes
+	// Login is the GitHub login of the user that authorized the application.
+	// It is only set if Options.FetchUser is true.
+	Login string
+	// VerificationURL and VerificationURLComplete are the URLs shown to the
+	// user in the prompt for the device code that was authorized.
+	VerificationURL         string
+	VerificationURLComplete string
+	// RefreshToken is the token used to obtain a new access token once
+	// AccessToken expires. It is empty unless the token is expiring.
+	RefreshToken string
+	// ObtainedAt is the time at which the access token response arrived.
+	ObtainedAt time.Time
+	// ExpiresAt is the time at which AccessToken expires. It is the zero
+	// time for tokens that do not expire, like those for OAuth applications
+	// and for GitHub Apps that have opted out of token expiration.
+	//
+	// GitHub reports the token's lifetime relative to when it responded, so
+	// ExpiresAt is computed from the response's Date header if it falls
+	// between sending the request and receiving the response, and from
+	// ObtainedAt otherwise. A Date header from a server whose clock is
+	// skewed from the local clock is therefore ignored.
+	ExpiresAt time.Time
+	// Response holds every field of GitHub's successful access token
+	// response, including ones this package does not model, like "scope".
+	// Secrets such as the access token itself are removed.
+	Response url.Values
+
+	// Duration is the total wall-clock time the flow took,
+	// including the time spent waiting for the user.
+	Duration time.Duration
+	// Prompts is the number of times the prompter was called.
+	Prompts int
+	// Polls is the number of access token requests made to GitHub.
+	Polls int
+	// Interval is the polling interval in effect when polling stopped,
+	// after any requests from GitHub to slow down. It is zero if the flow
+	// never started polling.
+	Interval time.Duration
+	// Err is the error that ended the flow, or nil if it succeeded.
+	Err error
+}
+
+// ParseTokenResponse parses a successful response from the access token
+// endpoint into a FlowResult, for programs that make requests themselves but
+// want the same result as RunFlow. Only the token fields of the result are
+// set. If v holds an OAuth error, ParseTokenResponse returns an *OAuthError.
+// ObtainedAt is set to the current time, from which ExpiresAt is computed.
+func ParseTokenResponse(v url.Values) (*FlowResult, error) {
+	result := new(FlowResult)
+	if err := result.parseTokenResponse(v, exchangeTimes{received: time.Now()}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// parseTokenResponse sets the token fields of result from v, which was
+// received at the given times.
+func (result *FlowResult) parseTokenResponse(v url.Values, times exchangeTimes) error {
+	if oauthErr := newOAuthError(v); oauthErr != nil {
+		return oauthErr
+	}
+	token := v.Get("access_token")
+	if token == "" {
+		return errors.New("server did not return an access token")
+	}
+	result.AccessToken = token
+	result.TokenType = v.Get("token_type")
+	result.Scopes = strings.FieldsFunc(v.Get("scope"), func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	result.RefreshToken = v.Get("refresh_token")
+	result.ObtainedAt = times.received
+	result.ExpiresAt = time.Time{}
+	if expiresIn := parseSeconds(v.Get("expires_in"), 0); expiresIn > 0 {
+		result.ExpiresAt = times.issuedAt().Add(expiresIn)
+	}
+	result.Response = redactTokenResponse(v)
+	return nil
+}
+
+// IsExpiring reports whether the access token expires, in which case the
+// caller should use the refresh token to obtain a new access token before
+// ExpiresAt.
+func (result *FlowResult) IsExpiring() bool {
+	return !result.ExpiresAt.IsZero()
 }
 
 // Flow runs the GitHub device flow, waiting until the user has authorized the
@@ -114,190 +728,836 @@ type Prompt struct {
 // user does not complete the GitHub prompt in time, then Flow may call
 // opts.Prompter again to present a new URL and/or code. If opts.Prompter
 // returns an error, then Flow returns the error wrapped with additional detail.
+// If the Context is cancelled or its deadline is exceeded, the returned error
+// matches ErrCanceled or ErrTimeout, respectively, when tested with errors.Is.
 func Flow(ctx context.Context, opts Options) (string, error) {
-	if opts.ClientID == "" {
-		return "", fmt.Errorf("github authorization flow: client ID not provided")
+	result, err := RunFlow(ctx, opts)
+	if err != nil {
+		return "", err
+	}
+	return result.AccessToken, nil
+}
+
+// FlowWithTimeout runs Flow, giving up if the user has not authorized the
+// application within the given duration. If it gives up, the returned error
+// says how long it waited and matches ErrTimeout when tested with errors.Is.
+func FlowWithTimeout(parent context.Context, timeout time.Duration, opts Options) (string, error) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	token, err := Flow(ctx, opts)
+	if err != nil {
+		// Only blame the timeout if it is what ended the flow,
+		// not opts.Deadline or a deadline of parent.
+		deadline, _ := ctx.Deadline()
+		timedOut := ctx.Err() != nil && parent.Err() == nil &&
+			(opts.Deadline.IsZero() || opts.Deadline.After(deadline))
+		if errors.Is(err, ErrTimeout) && timedOut {
+			cause := doneError(ctx)
+			if ie := (*InterruptedError)(nil); errors.As(err, &ie) {
+				cause = ie
+			}
+			return "", fmt.Errorf("github authorization flow: not authorized within %v: %w", timeout, cause)
+		}
+		return "", err
+	}
+	return token, nil
+}
+
+// RunFlow runs the GitHub device flow like Flow, but returns additional
+// information about the run. RunFlow always returns a non-nil FlowResult,
+// even if the flow fails, so that callers can record how far the flow got.
+func RunFlow(ctx context.Context, opts Options) (*FlowResult, error) {
+	start := time.Now()
+	m := opts.metrics()
+	m.IncFlowStarted()
+	result := new(FlowResult)
+	err := runFlow(ctx, opts, result)
+	result.Err = err
+	result.Duration = time.Since(start)
+	m.ObserveFlowDuration(result.Duration)
+	if err != nil {
+		if errors.Is(err, ErrAccessDenied) {
+			m.IncFlowDenied()
+		}
+		opts.emit(Event{Type: Failed, Err: err})
+	} else {
+		m.IncFlowSucceeded()
+		opts.emit(Event{Type: Succeeded})
+	}
+	return result, err
+}
+
+// StartFlow runs RunFlow in a new goroutine. The returned channel receives
+// the flow's result, with Err set if the flow failed, and is then closed.
+// Calling cancel stops the flow, which then reports ErrCanceled. cancel may be
+// called more than once and after the flow has finished; the caller must call
+// it to release the flow's resources.
+func StartFlow(ctx context.Context, opts Options) (resultCh <-chan FlowResult, cancel func()) {
+	ctx, cancel = context.WithCancel(ctx)
+	c := make(chan FlowResult, 1)
+	go func() {
+		defer close(c)
+		result, _ := RunFlow(ctx, opts)
+		c <- *result
+	}()
+	return c, cancel
+}
+
+func runFlow(ctx context.Context, opts Options, result *FlowResult) error {
+	if opts.clientID() == "" {
+		return fmt.Errorf("github authorization flow: client ID not provided")
 	}
 	if opts.Prompter == nil {
-		return "", fmt.Errorf("github authorization flow: prompter not provided")
+		return fmt.Errorf("github authorization flow: prompter not provided")
+	}
+	if opts.StrictScopes {
+		if err := checkScopes(opts.Scopes); err != nil {
+			return fmt.Errorf("github authorization flow: %w", err)
+		}
+	}
+	if !opts.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, opts.Deadline)
+		defer cancel()
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("github authorization flow: %w", doneError(ctx))
+	}
+	if opts.Semaphore != nil {
+		select {
+		case opts.Semaphore <- struct{}{}:
+			defer func() { <-opts.Semaphore }()
+		case <-ctx.Done():
+			return fmt.Errorf("github authorization flow: %w", doneError(ctx))
+		}
+	}
+	// Work on a copy so that the caller's Options are never modified.
+	opts = opts.Clone()
+	opts, done := opts.withTLSClient()
+	defer done()
+	if opts.HTTPClient != nil && opts.HTTPClient.Timeout > 0 {
+		opts.logf("HTTPClient.Timeout (%v) applies to each request, not the whole flow", opts.HTTPClient.Timeout)
 	}
 
 	for {
 		// Obtain device code.
-		codeData, err := post(ctx, opts.client(), opts.UserAgent, opts.url("/login/device/code"), url.Values{
-			"client_id": {opts.ClientID},
-			"scope":     {strings.Join(opts.Scopes, " ")},
-		})
+		dc, err := requestDeviceCode(ctx, opts)
 		if err != nil {
-			return "", fmt.Errorf("github authorization flow: get device code: %w", err)
+			if ctx.Err() != nil {
+				if result.Prompts == 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					// The user never saw a prompt, so the deadline was spent
+					// waiting for GitHub rather than for the user.
+					return fmt.Errorf("github authorization flow: could not reach GitHub: %w", doneError(ctx))
+				}
+				return fmt.Errorf("github authorization flow: %w", doneError(ctx))
+			}
+			return fmt.Errorf("github authorization flow: %w", err)
+		}
+		if opts.OnDeviceCode != nil {
+			if err := opts.OnDeviceCode(ctx, *dc); err != nil {
+				return fmt.Errorf("github authorization flow: device code callback: %w", err)
+			}
 		}
 
 		// Set up Context for the user to poll.
-		expiry := parseSeconds(codeData.Get("expires_in"), 15*time.Minute)
-		pollCtx, cancelPoll := context.WithDeadline(ctx, time.Now().Add(expiry))
+		pollCtx, cancelPoll := context.WithDeadline(ctx, dc.ExpiresAt)
 
 		// Present the user with the URL and user code.
-		err = opts.Prompter(pollCtx, Prompt{
-			VerificationURL: codeData.Get("verification_uri"),
-			UserCode:        codeData.Get("user_code"),
-		})
+		prompt := dc.Prompt()
+		if opts.UserCodeFormatter != nil {
+			prompt.UserCode = opts.UserCodeFormatter(prompt.UserCode)
+		}
+		opts.emit(Event{Type: DeviceCodeReceived, Prompt: prompt})
+		result.Prompts++
+		err = opts.Prompter(pollCtx, prompt)
+		for retries := 0; retries < opts.PromptRetries && err != nil && !errors.Is(err, ErrNewCode) && pollCtx.Err() == nil; retries++ {
+			opts.logf("prompt failed, retrying: %v", err)
+			result.Prompts++
+			err = opts.Prompter(pollCtx, prompt)
+		}
+		if errors.Is(err, ErrNewCode) {
+			cancelPoll()
+			opts.emit(Event{Type: Reprompt})
+			continue
+		}
 		if err != nil {
+			expired := pollCtx.Err() != nil
+			cancelPoll()
+			if ctx.Err() != nil {
+				return fmt.Errorf("github authorization flow: %w", result.interrupted(dc, doneError(ctx)))
+			}
+			if expired {
+				// Code expired while the prompter was waiting for the user.
+				opts.reprompted(ctx, prompt)
+				opts.emit(Event{Type: Reprompt})
+				continue
+			}
+			return fmt.Errorf("github authorization flow: prompt: %w", err)
+		}
+		opts.emit(Event{Type: PromptShown, Prompt: prompt})
+		if opts.DryRun {
 			cancelPoll()
-			return "", fmt.Errorf("github authorization flow: prompt: %w", err)
+			return fmt.Errorf("github authorization flow: %w", ErrDryRun)
 		}
 
 		// Wait for GitHub to reply with the access token.
-		interval := parseSeconds(codeData.Get("interval"), 5*time.Second)
-		token, err := waitForAccessToken(pollCtx, opts, codeData.Get("device_code"), interval)
+		interval := dc.Interval
+		if delay := opts.InitialDelay - interval; delay > 0 {
+			// The first poll happens one interval after waitForAccessToken starts.
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-pollCtx.Done():
+				t.Stop()
+			}
+		}
+		var times exchangeTimes
+		resp, err := waitForAccessToken(pollCtx, opts, dc.DeviceCode, &interval, &result.Polls, &times)
 		cancelPoll()
+		result.Interval = interval
 		if err == nil {
-			return token, nil
+			if err := result.parseTokenResponse(resp, times); err != nil {
+				return fmt.Errorf("github authorization flow: get access token: %w", err)
+			}
+			result.VerificationURL = prompt.VerificationURL
+			result.VerificationURLComplete = prompt.VerificationURLComplete
+			if opts.FetchUser {
+				result.Login, err = fetchLogin(ctx, opts, result.AccessToken)
+				if err != nil {
+					return fmt.Errorf("github authorization flow: %w", err)
+				}
+			}
+			if opts.OnToken != nil {
+				if err := opts.OnToken(ctx, *result); err != nil {
+					return fmt.Errorf("github authorization flow: token callback: %w", err)
+				}
+			}
+			return nil
 		}
 		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
-			return "", fmt.Errorf("github authorization flow: %w", err)
+			return fmt.Errorf("github authorization flow: %w", err)
+		}
+		if expiringSoon(ctx, interval) {
+			// The device code's deadline and the overall Context's deadline can
+			// fire in either order. If the Context will be done before a new code
+			// could be polled even once, report the timeout instead of re-prompting.
+			err := &contextError{sentinel: ErrTimeout, err: context.DeadlineExceeded}
+			return fmt.Errorf("github authorization flow: %w", result.interrupted(dc, err))
 		}
 		select {
 		case <-ctx.Done():
 			// If the overall Context has been cancelled or its deadline exceeded, then
 			// return that error.
-			return "", fmt.Errorf("github authorization flow: %w", ctx.Err())
+			return fmt.Errorf("github authorization flow: %w", result.interrupted(dc, doneError(ctx)))
 		default:
 			// Otherwise, we need to prompt the user again.
+			opts.reprompted(ctx, prompt)
+			opts.emit(Event{Type: Reprompt})
 		}
 	}
 }
 
-func waitForAccessToken(ctx context.Context, opts Options, deviceCode string, interval time.Duration) (string, error) {
-	params := url.Values{
-		"client_id":   {opts.ClientID},
-		"device_code": {deviceCode},
-		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+// reprompted records that the previous device code expired
+// and calls opts.OnReprompt, if set.
+func (opts Options) reprompted(ctx context.Context, previous Prompt) {
+	opts.metrics().IncCodeExpired()
+	if opts.OnReprompt != nil {
+		opts.OnReprompt(ctx, previous)
 	}
-	ticker := time.NewTicker(interval)
-	defer func() {
-		// The ticker can be reassigned, so evaluate ticker when defer is called.
-		ticker.Stop()
-	}()
+}
+
+// expiringSoon reports whether ctx has a deadline less than d from now.
+func expiringSoon(ctx context.Context, d time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && time.Until(deadline) < d
+}
+
+// Errors returned by Flow when its Context is done. The underlying Context
+// error (context.Canceled or context.DeadlineExceeded) is also present in the
+// error chain.
+var (
+	// ErrCanceled indicates that the Context passed to Flow was cancelled.
+	ErrCanceled = errors.New("authorization canceled")
+	// ErrTimeout indicates that the deadline of the Context passed to Flow
+	// was exceeded before the user authorized the application.
+	ErrTimeout = errors.New("timed out waiting for authorization")
+)
+
+// ErrDryRun is returned by Flow after prompting if Options.DryRun is set.
+var ErrDryRun = errors.New("dry run: stopped after prompt")
+
+// ErrTooManyPolls indicates that the flow made Options.MaxPolls access token
+// requests without the user authorizing the application.
+var ErrTooManyPolls = errors.New("too many polls")
+
+// doneError returns an error for a Context that is done that matches
+// ErrCanceled or ErrTimeout as well as the Context's error.
+func doneError(ctx context.Context) error {
+	err := ctx.Err()
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &contextError{sentinel: ErrTimeout, err: err}
+	}
+	return &contextError{sentinel: ErrCanceled, err: err}
+}
+
+// An InterruptedError describes a flow that stopped because its Context was
+// done after GitHub issued a device code and the user was prompted with it,
+// which permits a user interface to report what the user was doing, like
+// "canceled while waiting for code DED-BEF". It matches ErrCanceled or
+// ErrTimeout and the Context's error when tested with errors.Is.
+type InterruptedError struct {
+	// DeviceCode is the last device code that GitHub issued.
+	DeviceCode DeviceCode
+	// Prompts and Polls are the number of times the prompter was called and
+	// the number of access token requests made before the flow stopped.
+	Prompts int
+	Polls   int
+	// Err is the reason the flow stopped.
+	Err error
+}
+
+// Error returns the reason the flow stopped and the code it was waiting for.
+func (e *InterruptedError) Error() string {
+	return fmt.Sprintf("%v (while waiting for code %s)", e.Err, e.DeviceCode.UserCode)
+}
+
+// Unwrap returns e.Err.
+func (e *InterruptedError) Unwrap() error {
+	return e.Err
+}
+
+// interrupted returns an *InterruptedError for a flow that stopped because
+// of err while waiting for dc.
+func (result *FlowResult) interrupted(dc *DeviceCode, err error) error {
+	return &InterruptedError{
+		DeviceCode: *dc,
+		Prompts:    result.Prompts,
+		Polls:      result.Polls,
+		Err:        err,
+	}
+}
+
+type contextError struct {
+	sentinel error
+	err      error
+}
+
+func (e *contextError) Error() string {
+	return e.sentinel.Error() + ": " + e.err.Error()
+}
+
+func (e *contextError) Is(target error) bool {
+	return target == e.sentinel
+}
+
+func (e *contextError) Unwrap() error {
+	return e.err
+}
+
+// waitForAccessToken polls GitHub until the user has authorized the device code
+// and returns the token response, which is guaranteed to have an access_token.
+// *interval is the initial polling interval; waitForAccessToken updates it
+// when GitHub asks the client to slow down or opts.PendingBackoff applies.
+// It increments *polls for every request made. If times is not nil,
+// waitForAccessToken stores the times of the successful exchange in it.
+func waitForAccessToken(ctx context.Context, opts Options, deviceCode string, interval *time.Duration, polls *int, times *exchangeTimes) (url.Values, error) {
+	params := TokenForm(opts, deviceCode)
+	initialInterval := *interval
+	// The next poll is scheduled one interval after the previous one
+	// completes, rather than on a fixed tick, so that a slow response does
+	// not cause the next poll to be sent immediately after it.
+	timer := time.NewTimer(initialInterval)
+	defer timer.Stop()
+	// scheduleNext starts waiting for the next poll, unless the poll limit
+	// has been reached, so that the flow does not wait an interval for
+	// a poll that it will not make.
+	scheduleNext := func() error {
+		if opts.MaxPolls > 0 && *polls >= opts.MaxPolls {
+			return fmt.Errorf("get access token: %w (limit is %d)", ErrTooManyPolls, opts.MaxPolls)
+		}
+		timer.Reset(*interval)
+		return nil
+	}
+	pending := 0
 	for {
 		select {
-		case <-ticker.C:
-			resp, err := post(ctx, opts.client(), opts.UserAgent, opts.url("/login/oauth/access_token"), params)
-			if oauthErr := (*oauthError)(nil); errors.As(err, &oauthErr) {
-				switch oauthErr.code {
+		case <-timer.C:
+			if ctx.Err() != nil {
+				// select chooses randomly among ready cases.
+				// Don't make a request if the Context is already done.
+				return nil, fmt.Errorf("get access token: %w", ctx.Err())
+			}
+			if opts.MaxPolls > 0 && *polls >= opts.MaxPolls {
+				return nil, fmt.Errorf("get access token: %w (limit is %d)", ErrTooManyPolls, opts.MaxPolls)
+			}
+			*polls++
+			resp, t, err := postTimed(ctx, opts, opts.tokenURL(), params, opts.TokenFormat)
+			opts.emit(Event{Type: Polled})
+			if oauthErr := (*OAuthError)(nil); errors.As(err, &oauthErr) {
+				switch oauthErr.Code {
 				case "authorization_pending":
 					// User has not completed input.
+					pending++
+					if opts.PendingBackoff > 0 && pending >= opts.PendingBackoff {
+						pending = 0
+						*interval = opts.backoffInterval(initialInterval, *interval)
+					}
+					if err := scheduleNext(); err != nil {
+						return nil, err
+					}
 					continue
 				case "slow_down":
 					// Server requesting backoff.
-					if oauthErr.interval > 0 {
-						ticker.Stop()
-						ticker = time.NewTicker(oauthErr.interval)
+					pending = 0
+					if oauthErr.RetryAfter > 0 {
+						*interval = opts.slowDownInterval(initialInterval, oauthErr.RetryAfter)
+						opts.emit(Event{Type: SlowDown, Interval: *interval})
+					}
+					opts.metrics().IncSlowDown()
+					if err := scheduleNext(); err != nil {
+						return nil, err
 					}
 					continue
 				case "expired_token":
 					// User took too long, but we didn't hit client-side deadline.
 					// Need to re-prompt.
-					return "", fmt.Errorf("get access token: %w", context.DeadlineExceeded)
+					return nil, fmt.Errorf("get access token: %w", context.DeadlineExceeded)
 				}
-
+			}
+			if isTimeout(err) && ctx.Err() == nil {
+				// The request timed out, but the device code is still valid.
+				// Try again at the next interval.
+				if err := scheduleNext(); err != nil {
+					return nil, err
+				}
+				continue
 			}
 			if err != nil {
-				return "", fmt.Errorf("get access token: %w", err)
+				return nil, fmt.Errorf("get access token: %w", err)
+			}
+			if len(resp) == 0 {
+				return nil, fmt.Errorf("get access token: server returned an empty response")
+			}
+			if resp.Get("access_token") == "" {
+				// Include the other fields to help debug the server.
+				return nil, fmt.Errorf("get access token: server did not return an access token (response: %q)",
+					redactTokenResponse(resp).Encode())
 			}
-			token := resp.Get("access_token")
-			if token == "" {
-				return "", fmt.Errorf("get access token: server did not return an access token")
+			if times != nil {
+				*times = t
 			}
-			return token, nil
+			return resp, nil
 		case <-ctx.Done():
-			return "", fmt.Errorf("get access token: %w", ctx.Err())
+			return nil, fmt.Errorf("get access token: %w", ctx.Err())
 		}
 	}
 }
 
+// secretTokenFields is the set of token response fields
+// that redactTokenResponse removes.
+var secretTokenFields = []string{"access_token", "refresh_token"}
+
+// redactTokenResponse returns a copy of resp without secrets.
+func redactTokenResponse(resp url.Values) url.Values {
+	redacted := make(url.Values, len(resp))
+	for k, v := range resp {
+		redacted[k] = append([]string(nil), v...)
+	}
+	for _, k := range secretTokenFields {
+		delete(redacted, k)
+	}
+	return redacted
+}
+
+// isTimeout reports whether err is the result of a request timing out,
+// either from a Context deadline or from http.Client.Timeout.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 const formMediaType = "application/x-www-form-urlencoded"
 
+// defaultUserAgent is the User-Agent header sent when Options.UserAgent is empty.
+var defaultUserAgent = "ghdevice/" + moduleVersion()
+
+// moduleVersion returns the version of this module linked into the binary
+// or "devel" if it cannot be determined.
+func moduleVersion() string {
+	const modulePath = "gg-scm.io/pkg/ghdevice"
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	mod := &info.Main
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			mod = dep
+			break
+		}
+	}
+	if mod.Path != modulePath || mod.Version == "" || mod.Version == "(devel)" {
+		return "devel"
+	}
+	return mod.Version
+}
+
 // post makes a POST request and parses its response.
 // We use this over golang.org/x/oauth2 because our needs are simpler and
 // we can avoid the dependency.
-func post(ctx context.Context, client *http.Client, userAgent string, u *url.URL, form url.Values) (url.Values, error) {
+func post(ctx context.Context, opts Options, u *url.URL, form url.Values, format Format) (url.Values, error) {
+	v, _, err := postTimed(ctx, opts, u, form, format)
+	return v, err
+}
+
+// exchangeTimes records the times of an exchange with the server.
+type exchangeTimes struct {
+	sent     time.Time // when the request was sent
+	received time.Time // when the response headers arrived
+	date     time.Time // the response's Date header, or zero if absent
+}
+
+// issuedAt returns the time from which lifetimes in the response,
+// like expires_in, should be counted.
+func (t exchangeTimes) issuedAt() time.Time {
+	// The Date header has a resolution of one second.
+	if !t.date.IsZero() && !t.date.Before(t.sent.Add(-time.Second)) && !t.date.After(t.received) {
+		return t.date
+	}
+	return t.received
+}
+
+// postTimed is like post, but also returns when the exchange happened.
+func postTimed(ctx context.Context, opts Options, u *url.URL, form url.Values, format Format) (url.Values, exchangeTimes, error) {
 	const contentType = "Content-Type"
-	formString := form.Encode()
+	var times exchangeTimes
+	if timeout := opts.requestTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := opts.checkURL(u); err != nil {
+		return nil, times, err
+	}
+	reqBody, err := format.encode(form)
+	if err != nil {
+		return nil, times, fmt.Errorf("post %v: %w", u, err)
+	}
 	req := (&http.Request{
 		Method: http.MethodPost,
 		URL:    u,
 		GetBody: func() (io.ReadCloser, error) {
-			return ioutil.NopCloser(strings.NewReader(formString)), nil
+			return ioutil.NopCloser(bytes.NewReader(reqBody)), nil
 		},
-		ContentLength: int64(len(formString)),
+		ContentLength: int64(len(reqBody)),
 		Header: http.Header{
-			contentType: {formMediaType},
-			"Accept":    {formMediaType},
+			contentType: {format.mediaType()},
+			"Accept":    {format.mediaType()},
 		},
 	}).WithContext(ctx)
 	req.Body, _ = req.GetBody()
-	if userAgent != "" {
-		req.Header.Set("User-Agent", userAgent)
-	}
-	resp, err := client.Do(req)
+	setCommonHeaders(req, opts)
+	times.sent = time.Now()
+	resp, err := opts.postClient().Do(req)
+	times.received = time.Now()
 	if err != nil {
-		return nil, fmt.Errorf("post %v: %w", u, err)
+		opts.transcribe(req.Method, u, form, nil, nil, err)
+		return nil, times, fmt.Errorf("post %v: %w", u, err)
+	}
+	defer drainAndClose(resp.Body)
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		times.date = date
+	}
+	warnDeprecation(opts, u, resp.Header)
+	var body io.Reader = resp.Body
+	if resp.ContentLength != 0 && strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		// The transport only decompresses responses to requests that it added
+		// Accept-Encoding to, so gzip sent unasked by a proxy (or received
+		// through a transport with compression disabled) arrives as-is.
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, times, fmt.Errorf("post %v: read response: %w", u, err)
+		}
+		defer zr.Close()
+		body = zr
 	}
-	defer resp.Body.Close()
 	var respValues url.Values
 	var readErr error
-	if mtype, _, err := mime.ParseMediaType(resp.Header.Get(contentType)); err != nil {
+	intercepted := false
+	ctype := resp.Header.Get(contentType)
+	if ctype == "" && opts.LenientContentType &&
+		(resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusBadRequest) {
+		ctype = format.mediaType()
+	}
+	if resp.ContentLength == 0 && ctype == "" {
+		// An empty response need not declare its type.
+		respValues = url.Values{}
+	} else if mtype, _, err := mime.ParseMediaType(ctype); err != nil {
 		readErr = fmt.Errorf("post %v: invalid Content-Type: %w", u, err)
-	} else if mtype != formMediaType {
-		readErr = fmt.Errorf("post %v: Content-Type is %q instead of form", u, mtype)
-	} else if data, err := ioutil.ReadAll(resp.Body); err != nil {
+	} else if mtype == "text/html" || mtype == "application/xhtml+xml" {
+		// Captive portals and intercepting proxies usually respond with a web
+		// page and a success, redirect, or 511 status. Other error pages,
+		// like GitHub's 404 page for a wrong URL, are reported as HTTPErrors.
+		intercepted = resp.StatusCode < 400 || resp.StatusCode == http.StatusNetworkAuthenticationRequired
+	} else if mtype != formMediaType && mtype != jsonMediaType {
+		readErr = fmt.Errorf("post %v: Content-Type is %q instead of %v", u, mtype, format)
+	} else if data, err := readResponse(body); err != nil {
 		readErr = fmt.Errorf("post %v: read response: %w", u, err)
+	} else if mtype == jsonMediaType {
+		if respValues, err = parseJSONValues(data); err != nil {
+			readErr = fmt.Errorf("post %v: read response: %w", u, err)
+		}
 	} else if respValues, err = url.ParseQuery(string(data)); err != nil {
 		readErr = fmt.Errorf("post %v: read response: %w", u, err)
 	}
+	opts.transcribe(req.Method, u, form, resp, respValues, nil)
 
+	switch {
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return nil, times, fmt.Errorf("post %v: %w: proxy requires authentication (check your network or proxy settings)", u, newHTTPError(u, resp))
+	case intercepted:
+		return nil, times, fmt.Errorf("post %v: %w: received a web page instead of an OAuth response (a captive portal or proxy may be intercepting requests)", u, newHTTPError(u, resp))
+	}
 	if resp.StatusCode != http.StatusOK || respValues.Get("error") != "" {
 		errorObject := newOAuthError(respValues)
 		if readErr != nil || errorObject == nil {
-			return nil, fmt.Errorf("post %v: http %s", u, resp.Status)
+			return nil, times, fmt.Errorf("post %v: %w", u, newHTTPError(u, resp))
+		}
+		if resp.StatusCode != http.StatusOK {
+			errorObject.err = newHTTPError(u, resp)
 		}
-		return nil, fmt.Errorf("post %v: %w", u, errorObject)
+		return nil, times, fmt.Errorf("post %v: %w", u, errorObject)
 	}
 	if readErr != nil {
-		return nil, readErr
+		return nil, times, readErr
+	}
+	return respValues, times, nil
+}
+
+// warnDeprecation logs a warning if the response headers indicate that the
+// endpoint is deprecated or will be removed.
+// See https://tools.ietf.org/html/draft-ietf-httpapi-deprecation-header
+// and https://tools.ietf.org/html/rfc8594.
+func warnDeprecation(opts Options, u *url.URL, h http.Header) {
+	if d := h.Get("Deprecation"); d != "" {
+		opts.logf("warning: %v is deprecated (Deprecation: %s)", u, d)
+	}
+	if s := h.Get("Sunset"); s != "" {
+		opts.logf("warning: %v will stop working after %s", u, s)
 	}
-	return respValues, nil
 }
 
-type oauthError struct {
-	code        string
-	description string
-	interval    time.Duration
+// maxResponseSize is the maximum size of an OAuth response body, after any
+// decompression. GitHub's responses are much smaller; the limit keeps a
+// misbehaving server or proxy from exhausting memory.
+const maxResponseSize = 1 << 20
+
+// readResponse reads a response body of at most maxResponseSize bytes.
+func readResponse(body io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxResponseSize {
+		return nil, fmt.Errorf("response is larger than %d bytes", maxResponseSize)
+	}
+	return data, nil
+}
+
+// maxDrain is the maximum number of unread response bytes that
+// drainAndClose will read to permit reusing the connection.
+const maxDrain = 1 << 20
+
+// drainAndClose reads any remaining data from a response body and closes it.
+// The HTTP client only reuses a keep-alive connection once its response body
+// has been read to the end, so this avoids opening a new connection for every
+// poll when a response is rejected without being read.
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(ioutil.Discard, io.LimitReader(body, maxDrain))
+	body.Close()
 }
 
-func newOAuthError(v url.Values) *oauthError {
-	e := &oauthError{
-		code:        v.Get("error"),
-		description: v.Get("error_description"),
+// setCommonHeaders sets the headers sent on every request.
+// It must be called after any request-specific headers are set.
+func setCommonHeaders(req *http.Request, opts Options) {
+	userAgent := opts.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent
 	}
-	if e.code == "" {
+	req.Header.Set("User-Agent", userAgent)
+	if id := RequestIDFromContext(req.Context()); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	for k, v := range opts.Header {
+		k = http.CanonicalHeaderKey(k)
+		if _, set := req.Header[k]; !set {
+			req.Header[k] = append([]string(nil), v...)
+		}
+	}
+}
+
+// HTTPError is returned for an HTTP response with an unexpected status code
+// that does not carry an OAuth error, such as a 404 from a wrong GitHubURL or
+// a 502 from a proxy. An *OAuthError that arrived with a status other than
+// 200 OK also wraps an HTTPError for the response.
+type HTTPError struct {
+	// StatusCode is the HTTP status code, like 404.
+	StatusCode int
+	// Status is the HTTP status line, like "404 Not Found".
+	Status string
+	// URL is the URL that was requested.
+	URL string
+}
+
+func newHTTPError(u *url.URL, resp *http.Response) *HTTPError {
+	return &HTTPError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		URL:        u.String(),
+	}
+}
+
+// Error returns a message like "http 404 Not Found".
+func (e *HTTPError) Error() string {
+	return "http " + e.Status
+}
+
+// OAuthError is an error response from GitHub's OAuth endpoints.
+// See https://docs.github.com/en/free-pro-team@latest/developers/apps/authorizing-oauth-apps#error-codes-for-the-device-flow
+// for the codes that GitHub returns.
+type OAuthError struct {
+	// Code is the error code, like "access_denied".
+	Code string
+	// Description is a human-readable description of the error, normalized
+	// to a single line. It may be empty.
+	Description string
+	// URI is a link to a human-readable webpage with more information
+	// about the error. It may be empty.
+	URI string
+	// RetryAfter is the polling interval requested by the server,
+	// as sent with a "slow_down" error. It is zero if the server did not
+	// request an interval.
+	RetryAfter time.Duration
+
+	err error // underlying cause, if any
+}
+
+func newOAuthError(v url.Values) *OAuthError {
+	e := &OAuthError{
+		Code:        v.Get("error"),
+		Description: normalizeDescription(v.Get("error_description")),
+		URI:         v.Get("error_uri"),
+	}
+	if e.Code == "" {
 		return nil
 	}
-	e.interval = parseSeconds(v.Get("interval"), 0)
+	e.RetryAfter = parseSeconds(v.Get("interval"), 0)
 	return e
 }
 
-func (e *oauthError) Error() string {
-	if e.description == "" {
-		return "oauth " + e.code
+// Patterns that indicate an error_description is still URL-encoded.
+var (
+	percentEscape = regexp.MustCompile(`%[0-9A-Fa-f]{2}`)
+	plusSpace     = regexp.MustCompile(`[[:alnum:]]\+[[:alnum:]]`)
+)
+
+// normalizeDescription cleans up an error_description for display.
+// GitHub sometimes sends descriptions that are still URL-encoded or that span
+// several lines, so normalizeDescription decodes a description that has no
+// spaces but does have percent-escapes or plus signs between words, then
+// replaces control characters and runs of whitespace with single spaces.
+func normalizeDescription(desc string) string {
+	if !strings.Contains(desc, " ") && (percentEscape.MatchString(desc) || plusSpace.MatchString(desc)) {
+		if decoded, err := url.QueryUnescape(desc); err == nil {
+			desc = decoded
+		}
+	}
+	desc = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, desc)
+	return strings.Join(strings.Fields(desc), " ")
+}
+
+// Error returns the error's description or its code if there is no description.
+// For errors caused by a misconfigured application, the message includes
+// advice on how to fix it.
+func (e *OAuthError) Error() string {
+	msg := e.Description
+	if msg == "" {
+		msg = "oauth " + e.Code
 	}
-	return e.description
+	if hint := oauthErrorHints[e.Code]; hint != "" {
+		msg += " (" + hint + ")"
+	}
+	return msg
+}
+
+// Unwrap returns the error underlying e, if any: an *HTTPError if the OAuth
+// error arrived with a status other than 200 OK, or nil otherwise.
+func (e *OAuthError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether target is the sentinel error for e's code,
+// like ErrAccessDenied for "access_denied".
+func (e *OAuthError) Is(target error) bool {
+	sentinel := oauthErrorSentinels[e.Code]
+	return sentinel != nil && sentinel == target
+}
+
+// Sentinel errors for OAuth error codes.
+// OAuthError values match these with errors.Is.
+var (
+	// ErrAccessDenied indicates that the user declined to authorize the application.
+	ErrAccessDenied = errors.New("access denied by user")
+	// ErrDeviceFlowDisabled indicates that the OAuth application
+	// does not have the device flow enabled.
+	ErrDeviceFlowDisabled = errors.New("device flow disabled")
+	// ErrUnsupportedGrantType indicates that the server does not support
+	// the device flow grant type.
+	ErrUnsupportedGrantType = errors.New("unsupported grant type")
+	// ErrIncorrectClientCredentials indicates that the server does not
+	// recognize the client ID.
+	ErrIncorrectClientCredentials = errors.New("incorrect client credentials")
+	// ErrInvalidGrant indicates that the server rejected the device code,
+	// for example because it was already used to obtain a token.
+	ErrInvalidGrant = errors.New("invalid grant")
+)
+
+var oauthErrorSentinels = map[string]error{
+	"access_denied":                ErrAccessDenied,
+	"device_flow_disabled":         ErrDeviceFlowDisabled,
+	"unsupported_grant_type":       ErrUnsupportedGrantType,
+	"incorrect_client_credentials": ErrIncorrectClientCredentials,
+	"invalid_grant":                ErrInvalidGrant,
+}
+
+// oauthErrorHints maps OAuth error codes to advice on fixing them.
+var oauthErrorHints = map[string]string{
+	"device_flow_disabled":         "enable device flow in your OAuth app settings",
+	"unsupported_grant_type":       "the server may not support the device flow",
+	"incorrect_client_credentials": "check that the client ID is correct",
+	"invalid_grant":                "the device code was rejected; it may have already been used",
 }
 
 func parseSeconds(s string, defaultDuration time.Duration) time.Duration {
-	n, err := strconv.ParseUint(s, 10, 32)
-	if err != nil || n == 0 {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		if n == 0 {
+			return defaultDuration
+		}
+		return time.Duration(n) * time.Second
+	}
+	// Tolerate decimals like "5.0" or "5.5", rounding up to whole seconds
+	// so that polls are never made sooner than requested.
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(f > 0 && f <= math.MaxUint32) {
 		return defaultDuration
 	}
-	return time.Duration(n) * time.Second
+	return time.Duration(math.Ceil(f)) * time.Second
 }
@@ -17,10 +17,17 @@
 package ghdevice
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -31,6 +38,7 @@ import (
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 func TestFlow(t *testing.T) {
@@ -38,17 +46,37 @@ func TestFlow(t *testing.T) {
 	const verificationURL = "https://example.com/login/device"
 	const userCode = "DED-BEF"
 	const deviceCode = "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"
+	// codes returns the device code and user code that the mock server
+	// issues for its nth device code request, so that tests can check that
+	// a re-prompt uses the new code.
+	codes := func(n int) (string, string) {
+		if n <= 1 {
+			return deviceCode, userCode
+		}
+		return fmt.Sprintf("%s-%d", deviceCode, n), fmt.Sprintf("%s-%d", userCode, n)
+	}
 	type accessTokenResponse struct {
 		statusCode int
 		values     url.Values
+		stall      bool // if true, don't respond until the client gives up
 	}
 	tests := []struct {
-		name        string
-		scopes      []string
-		responses   []accessTokenResponse
-		want        string
-		wantPrompts int
-		wantErr     bool
+		name          string
+		scopes        []string
+		wantScope     string
+		grantType     string
+		wantGrantType string // defaults to DefaultGrantType
+		newCodes      int    // number of prompts that return ErrNewCode
+		timeout       time.Duration
+		clientTimeout time.Duration
+		responses     []accessTokenResponse
+		want          string
+		wantPrompts   int
+		wantReprompts int // number of OnReprompt calls
+		wantPolls     int
+		wantErr       bool
+		wantErrIs     error  // if not nil, the error must match with errors.Is
+		wantErrText   string // if not empty, the error message must contain it
 	}{
 		{
 			name: "BasicSuccess",
@@ -64,10 +92,47 @@ func TestFlow(t *testing.T) {
 			},
 			want:        "xyzzy",
 			wantPrompts: 1,
+			wantPolls:   1,
+		},
+		{
+			name:          "GrantType",
+			grantType:     "device_code",
+			wantGrantType: "device_code",
+			responses: []accessTokenResponse{
+				{
+					statusCode: http.StatusOK,
+					values: url.Values{
+						"access_token": {"xyzzy"},
+						"token_type":   {"bearer"},
+						"scope":        {""},
+					},
+				},
+			},
+			want:        "xyzzy",
+			wantPrompts: 1,
+			wantPolls:   1,
 		},
 		{
-			name:   "Scopes",
-			scopes: []string{"repo", "user"},
+			name:      "GrantType/Blank",
+			grantType: "  ",
+			responses: []accessTokenResponse{
+				{
+					statusCode: http.StatusOK,
+					values: url.Values{
+						"access_token": {"xyzzy"},
+						"token_type":   {"bearer"},
+						"scope":        {""},
+					},
+				},
+			},
+			want:        "xyzzy",
+			wantPrompts: 1,
+			wantPolls:   1,
+		},
+		{
+			name:      "Scopes",
+			scopes:    []string{"repo", "user"},
+			wantScope: "repo user",
 			responses: []accessTokenResponse{
 				{
 					statusCode: http.StatusOK,
@@ -80,6 +145,25 @@ func TestFlow(t *testing.T) {
 			},
 			want:        "xyzzy",
 			wantPrompts: 1,
+			wantPolls:   1,
+		},
+		{
+			name:      "DuplicateScopes",
+			scopes:    []string{"repo", " repo ", ""},
+			wantScope: "repo",
+			responses: []accessTokenResponse{
+				{
+					statusCode: http.StatusOK,
+					values: url.Values{
+						"access_token": {"xyzzy"},
+						"token_type":   {"bearer"},
+						"scope":        {"repo"},
+					},
+				},
+			},
+			want:        "xyzzy",
+			wantPrompts: 1,
+			wantPolls:   1,
 		},
 		{
 			name: "Wait",
@@ -102,6 +186,60 @@ func TestFlow(t *testing.T) {
 			},
 			want:        "xyzzy",
 			wantPrompts: 1,
+			wantPolls:   2,
+		},
+		{
+			name:     "NewCode",
+			newCodes: 1,
+			responses: []accessTokenResponse{
+				{
+					statusCode: http.StatusOK,
+					values: url.Values{
+						"access_token": {"xyzzy"},
+						"token_type":   {"bearer"},
+						"scope":        {""},
+					},
+				},
+			},
+			want:        "xyzzy",
+			wantPrompts: 2,
+			wantPolls:   1,
+		},
+		{
+			name:    "StalledRequest",
+			timeout: 100 * time.Millisecond,
+			responses: []accessTokenResponse{
+				{stall: true},
+				{
+					statusCode: http.StatusOK,
+					values: url.Values{
+						"access_token": {"xyzzy"},
+						"token_type":   {"bearer"},
+						"scope":        {""},
+					},
+				},
+			},
+			want:        "xyzzy",
+			wantPrompts: 1,
+			wantPolls:   2,
+		},
+		{
+			name:          "ClientTimeout",
+			clientTimeout: 100 * time.Millisecond,
+			responses: []accessTokenResponse{
+				{stall: true},
+				{
+					statusCode: http.StatusOK,
+					values: url.Values{
+						"access_token": {"xyzzy"},
+						"token_type":   {"bearer"},
+						"scope":        {""},
+					},
+				},
+			},
+			want:        "xyzzy",
+			wantPrompts: 1,
+			wantPolls:   2,
 		},
 		{
 			name: "UserRejected",
@@ -116,6 +254,54 @@ func TestFlow(t *testing.T) {
 			},
 			wantErr:     true,
 			wantPrompts: 1,
+			wantPolls:   1,
+		},
+		{
+			name: "InvalidGrant",
+			responses: []accessTokenResponse{
+				{
+					statusCode: http.StatusBadRequest,
+					values: url.Values{
+						"error":             {"invalid_grant"},
+						"error_description": {"The device code is invalid."},
+					},
+				},
+			},
+			wantErr:     true,
+			wantErrIs:   ErrInvalidGrant,
+			wantErrText: "it may have already been used",
+			wantPrompts: 1,
+			wantPolls:   1,
+		},
+		{
+			name: "DeviceFlowDisabled",
+			responses: []accessTokenResponse{
+				{
+					statusCode: http.StatusBadRequest,
+					values: url.Values{
+						"error":             {"device_flow_disabled"},
+						"error_description": {"Device flow must be enabled for this App."},
+					},
+				},
+			},
+			wantErr:     true,
+			wantPrompts: 1,
+			wantPolls:   1,
+		},
+		{
+			name: "IncorrectClientCredentials",
+			responses: []accessTokenResponse{
+				{
+					statusCode: http.StatusBadRequest,
+					values: url.Values{
+						"error":             {"incorrect_client_credentials"},
+						"error_description": {"The client_id is not valid."},
+					},
+				},
+			},
+			wantErr:     true,
+			wantPrompts: 1,
+			wantPolls:   1,
 		},
 		{
 			name: "ExpiredToken",
@@ -136,15 +322,95 @@ func TestFlow(t *testing.T) {
 					},
 				},
 			},
+			want:          "xyzzy",
+			wantPrompts:   2,
+			wantReprompts: 1,
+			wantPolls:     2,
+		},
+		// GitHub has historically sent OAuth errors with a 200 status,
+		// which must be handled like the same errors with a 400 status.
+		{
+			name: "Wait/Status200",
+			responses: []accessTokenResponse{
+				{
+					statusCode: http.StatusOK,
+					values: url.Values{
+						"error":             {"authorization_pending"},
+						"error_description": {"authorization pending: waiting for user input"},
+					},
+				},
+				{
+					statusCode: http.StatusOK,
+					values: url.Values{
+						"access_token": {"xyzzy"},
+						"token_type":   {"bearer"},
+						"scope":        {""},
+					},
+				},
+			},
 			want:        "xyzzy",
-			wantPrompts: 2,
+			wantPrompts: 1,
+			wantPolls:   2,
+		},
+		{
+			name: "SlowDown/Status200",
+			responses: []accessTokenResponse{
+				{
+					statusCode: http.StatusOK,
+					values: url.Values{
+						"error":    {"slow_down"},
+						"interval": {"2"},
+					},
+				},
+				{
+					statusCode: http.StatusOK,
+					values: url.Values{
+						"access_token": {"xyzzy"},
+						"token_type":   {"bearer"},
+						"scope":        {""},
+					},
+				},
+			},
+			want:        "xyzzy",
+			wantPrompts: 1,
+			wantPolls:   2,
+		},
+		{
+			name: "ExpiredToken/Status200",
+			responses: []accessTokenResponse{
+				{
+					statusCode: http.StatusOK,
+					values: url.Values{
+						"error":             {"expired_token"},
+						"error_description": {"User took too long"},
+					},
+				},
+				{
+					statusCode: http.StatusOK,
+					values: url.Values{
+						"access_token": {"xyzzy"},
+						"token_type":   {"bearer"},
+						"scope":        {""},
+					},
+				},
+			},
+			want:          "xyzzy",
+			wantPrompts:   2,
+			wantReprompts: 1,
+			wantPolls:     2,
 		},
 	}
 
 	for _, test := range tests {
+		test := test
 		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
 			mux := http.NewServeMux()
 
+			var issued struct {
+				mu sync.Mutex
+				n  int
+			}
 			mux.HandleFunc("/login/device/code", func(w http.ResponseWriter, r *http.Request) {
 				body, err := ioutil.ReadAll(r.Body)
 				if err != nil {
@@ -156,15 +422,19 @@ func TestFlow(t *testing.T) {
 				}
 				wantValues := url.Values{
 					"client_id": {clientID},
-					"scope":     {strings.Join(test.scopes, " ")},
+					"scope":     {test.wantScope},
 				}
 				if diff := cmp.Diff(wantValues, values); diff != "" {
 					t.Errorf("device code request (-want +got):\n%s", diff)
 				}
 
+				issued.mu.Lock()
+				issued.n++
+				dc, uc := codes(issued.n)
+				issued.mu.Unlock()
 				respBody := url.Values{
-					"device_code":      {deviceCode},
-					"user_code":        {userCode},
+					"device_code":      {dc},
+					"user_code":        {uc},
 					"verification_uri": {verificationURL},
 					"expires_in":       {"10"},
 					"interval":         {"1"},
@@ -189,10 +459,17 @@ func TestFlow(t *testing.T) {
 				if err != nil {
 					t.Error("parse access token body:", err)
 				}
+				wantGrantType := test.wantGrantType
+				if wantGrantType == "" {
+					wantGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+				}
+				issued.mu.Lock()
+				wantDeviceCode, _ := codes(issued.n)
+				issued.mu.Unlock()
 				wantValues := url.Values{
 					"client_id":   {clientID},
-					"device_code": {deviceCode},
-					"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+					"device_code": {wantDeviceCode},
+					"grant_type":  {wantGrantType},
 				}
 				if diff := cmp.Diff(wantValues, values); diff != "" {
 					t.Errorf("access token request (-want +got):\n%s", diff)
@@ -205,6 +482,10 @@ func TestFlow(t *testing.T) {
 				}
 				responseProgress.mu.Unlock()
 
+				if test.responses[i].stall {
+					<-r.Context().Done()
+					return
+				}
 				respBody := test.responses[i].values.Encode()
 				w.Header().Set("Content-Type", formMediaType+"; charset=utf-8")
 				w.Header().Set("Content-Length", strconv.Itoa(len(respBody)))
@@ -221,115 +502,1411 @@ func TestFlow(t *testing.T) {
 				t.Fatal(err)
 			}
 			var prompts struct {
-				mu    sync.Mutex
-				count int
+				mu        sync.Mutex
+				count     int
+				reprompts int
 			}
-			got, err := Flow(context.Background(), Options{
-				ClientID:   clientID,
-				GitHubURL:  u,
-				HTTPClient: srv.Client(),
+			scopes := append([]string(nil), test.scopes...)
+			client := *srv.Client()
+			client.Timeout = test.clientTimeout
+			result, err := RunFlow(context.Background(), Options{
+				ClientID:      clientID,
+				GitHubURL:     u,
+				AllowInsecure: true,
+				HTTPClient:    &client,
 				Prompter: func(_ context.Context, got Prompt) error {
 					prompts.mu.Lock()
 					prompts.count++
+					n := prompts.count
 					prompts.mu.Unlock()
+					_, wantUserCode := codes(n)
 					want := Prompt{
-						UserCode:        userCode,
+						UserCode:        wantUserCode,
+						RawUserCode:     wantUserCode,
 						VerificationURL: verificationURL,
 					}
-					if diff := cmp.Diff(want, got); diff != "" {
+					if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(Prompt{}, "ExpiresIn", "ExpiresAt", "Response")); diff != "" {
 						t.Errorf("prompt (-want +got):\n%s", diff)
 					}
+					if got.ExpiresIn <= 9*time.Second || got.ExpiresIn > 10*time.Second {
+						t.Errorf("prompt.ExpiresIn = %v; want ~10s", got.ExpiresIn)
+					}
+					if until := time.Until(got.ExpiresAt); until <= 9*time.Second || until > 10*time.Second {
+						t.Errorf("prompt.ExpiresAt = %v (in %v); want ~10s from now", got.ExpiresAt, until)
+					}
+					if n <= test.newCodes {
+						return ErrNewCode
+					}
 					return nil
 				},
-				Scopes: test.scopes,
+				OnReprompt: func(_ context.Context, previous Prompt) {
+					prompts.mu.Lock()
+					prompts.reprompts++
+					_, wantUserCode := codes(prompts.count)
+					prompts.mu.Unlock()
+					if previous.UserCode != wantUserCode {
+						t.Errorf("OnReprompt previous.UserCode = %q; want %q", previous.UserCode, wantUserCode)
+					}
+				},
+				Scopes:         scopes,
+				GrantType:      test.grantType,
+				RequestTimeout: test.timeout,
 			})
+			if diff := cmp.Diff(test.scopes, scopes); diff != "" {
+				t.Errorf("Options.Scopes modified (-before +after):\n%s", diff)
+			}
 			prompts.mu.Lock()
 			finalPromptCount := prompts.count
+			finalRepromptCount := prompts.reprompts
 			prompts.mu.Unlock()
+			if finalRepromptCount != test.wantReprompts {
+				t.Errorf("OnReprompt called %d time(s); want %d", finalRepromptCount, test.wantReprompts)
+			}
 			if finalPromptCount != test.wantPrompts {
 				t.Errorf("%d prompt(s) delivered; want %d", finalPromptCount, test.wantPrompts)
 			}
+			if result.Prompts != finalPromptCount {
+				t.Errorf("result.Prompts = %d; want %d", result.Prompts, finalPromptCount)
+			}
+			if result.Polls != test.wantPolls {
+				t.Errorf("result.Polls = %d; want %d", result.Polls, test.wantPolls)
+			}
+			if result.Duration <= 0 {
+				t.Errorf("result.Duration = %v; want >0", result.Duration)
+			}
 			if err != nil {
-				t.Log("Flow:", err)
+				t.Log("RunFlow:", err)
 				if !test.wantErr {
 					t.Fail()
 				}
+				if test.wantErrIs != nil && !errors.Is(err, test.wantErrIs) {
+					t.Errorf("errors.Is(err, %v) = false; want true", test.wantErrIs)
+				}
+				if !strings.Contains(err.Error(), test.wantErrText) {
+					t.Errorf("error does not contain %q", test.wantErrText)
+				}
 				return
 			}
 			if test.wantErr {
-				t.Fatalf("Flow(...) = %q, <nil>; want _, <error>", got)
+				t.Fatalf("RunFlow(...).AccessToken = %q, <nil>; want _, <error>", result.AccessToken)
 			}
-			if got != test.want {
-				t.Errorf("Flow(...) = %q, <nil>; want %q, <nil>", got, test.want)
+			if result.AccessToken != test.want {
+				t.Errorf("RunFlow(...).AccessToken = %q, <nil>; want %q, <nil>", result.AccessToken, test.want)
 			}
 		})
 	}
 }
 
-func TestPost(t *testing.T) {
-	t.Run("Request", func(t *testing.T) {
-		const userAgent = "me 1.2.3"
-		var firstRequest sync.Once
-		want := url.Values{
-			"foo": {"bar"},
-			"baz": {"quux"},
+func TestFlowContextDone(t *testing.T) {
+	t.Parallel()
+	t.Run("Canceled", func(t *testing.T) {
+		opts := startTestServer(t, pendingForever)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		opts.Prompter = func(context.Context, Prompt) error {
+			cancel()
+			return nil
 		}
-		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			first := false
-			firstRequest.Do(func() {
-				first = true
-				if r.Method != http.MethodPost {
-					t.Errorf("method = %q; want %q", r.Method, http.MethodPost)
-				}
-				body, err := ioutil.ReadAll(r.Body)
-				if err != nil {
-					t.Error("Read request body:", err)
-					return
-				}
-				if got := r.Header.Get("Content-Type"); got != formMediaType {
-					t.Errorf("Content-Type = %q; want %q", want, formMediaType)
-				}
-				if got := r.Header.Get("Accept"); got != formMediaType {
-					t.Errorf("Accept = %q; want %q", want, formMediaType)
-				}
-				if got := r.Header.Get("User-Agent"); got != userAgent {
-					t.Errorf("User-Agent = %q; want %q", got, userAgent)
-				}
-				got, err := url.ParseQuery(string(body))
-				if err != nil {
-					t.Error("Parse request body:", err)
-				}
-				if diff := cmp.Diff(want, got); diff != "" {
-					t.Errorf("body values (-want +got):\n%s", diff)
-				}
-			})
-			if !first {
-				const msg = "Multiple requests to endpoint"
-				t.Error(msg)
-				http.Error(w, msg, http.StatusUnprocessableEntity)
-				return
-			}
-			w.Header().Set("Content-Type", formMediaType)
-			w.Header().Set("Content-Length", "0")
-			w.WriteHeader(http.StatusOK)
-		}))
-		t.Cleanup(srv.Close)
-
-		u, err := url.Parse(srv.URL)
-		if err != nil {
-			t.Fatal(err)
+		_, err := Flow(ctx, opts)
+		t.Log("Flow:", err)
+		if !errors.Is(err, ErrCanceled) {
+			t.Error("errors.Is(err, ErrCanceled) = false; want true")
 		}
-		_, err = post(context.Background(), srv.Client(), userAgent, u, want)
-		if err != nil {
-			t.Error("post:", err)
+		if !errors.Is(err, context.Canceled) {
+			t.Error("errors.Is(err, context.Canceled) = false; want true")
 		}
-		received := true
-		firstRequest.Do(func() { received = false })
-		if !received {
-			t.Error("Request never sent")
+		if errors.Is(err, ErrTimeout) {
+			t.Error("errors.Is(err, ErrTimeout) = true; want false")
+		}
+		var ie *InterruptedError
+		if !errors.As(err, &ie) {
+			t.Fatal("errors.As(err, new(*InterruptedError)) = false; want true")
+		}
+		if ie.DeviceCode.UserCode != "DED-BEF" || ie.Prompts != 1 {
+			t.Errorf("InterruptedError{UserCode: %q, Prompts: %d}; want {UserCode: \"DED-BEF\", Prompts: 1}",
+				ie.DeviceCode.UserCode, ie.Prompts)
+		}
+		if !strings.Contains(err.Error(), "DED-BEF") {
+			t.Error("error does not mention the user code")
 		}
 	})
-
+	t.Run("CanceledBeforeDeviceCode", func(t *testing.T) {
+		opts := startTestServer(t, pendingForever)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := Flow(ctx, opts)
+		t.Log("Flow:", err)
+		if !errors.Is(err, ErrCanceled) {
+			t.Error("errors.Is(err, ErrCanceled) = false; want true")
+		}
+		if ie := (*InterruptedError)(nil); errors.As(err, &ie) {
+			t.Errorf("Flow returned an InterruptedError for code %q before obtaining one", ie.DeviceCode.UserCode)
+		}
+	})
+	t.Run("Timeout", func(t *testing.T) {
+		opts := startTestServer(t, pendingForever)
+		ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+		defer cancel()
+		_, err := Flow(ctx, opts)
+		t.Log("Flow:", err)
+		if !errors.Is(err, ErrTimeout) {
+			t.Error("errors.Is(err, ErrTimeout) = false; want true")
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Error("errors.Is(err, context.DeadlineExceeded) = false; want true")
+		}
+		if errors.Is(err, ErrCanceled) {
+			t.Error("errors.Is(err, ErrCanceled) = true; want false")
+		}
+	})
+	t.Run("SlowDownNearExpiry", func(t *testing.T) {
+		// The device code expires 2 seconds after it is issued, but the first
+		// poll asks the client to slow down past that. The overall Context's
+		// deadline is less than the slowed-down interval after the code's
+		// expiry (but more than the original interval), so Flow must not prompt
+		// again with a code that could never be polled, nor wait for the
+		// Context to be done before returning.
+		mux := http.NewServeMux()
+		mux.HandleFunc("/login/device/code", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", formMediaType)
+			io.WriteString(w, url.Values{
+				"device_code":      {"xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"},
+				"user_code":        {"DED-BEF"},
+				"verification_uri": {"https://example.com/login/device"},
+				"expires_in":       {"2"},
+				"interval":         {"1"},
+			}.Encode())
+		})
+		mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", formMediaType)
+			io.WriteString(w, "error=slow_down&interval=5")
+		})
+		srv := httptest.NewServer(mux)
+		t.Cleanup(srv.Close)
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+		defer cancel()
+		events := make(chan Event, 100)
+		result, err := RunFlow(ctx, Options{
+			ClientID:      "cafe1234",
+			GitHubURL:     u,
+			AllowInsecure: true,
+			HTTPClient:    srv.Client(),
+			Prompter: func(context.Context, Prompt) error {
+				return nil
+			},
+			Events: events,
+		})
+		t.Log("RunFlow:", err)
+		if !errors.Is(err, ErrTimeout) {
+			t.Error("errors.Is(err, ErrTimeout) = false; want true")
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Error("errors.Is(err, context.DeadlineExceeded) = false; want true")
+		}
+		if ctx.Err() != nil {
+			t.Error("RunFlow waited for the Context to be done")
+		}
+		if result.Prompts != 1 {
+			t.Errorf("result.Prompts = %d; want 1", result.Prompts)
+		}
+		close(events)
+		for ev := range events {
+			if ev.Type == Reprompt {
+				t.Error("Flow emitted a Reprompt event")
+			}
+		}
+	})
+	t.Run("CanceledDuringSlowDown", func(t *testing.T) {
+		opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", formMediaType)
+			io.WriteString(w, "error=slow_down&interval=60")
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		events := make(chan Event, 100)
+		opts.Events = events
+		go func() {
+			for ev := range events {
+				if ev.Type == SlowDown {
+					cancel()
+				}
+			}
+		}()
+		start := time.Now()
+		_, err := Flow(ctx, opts)
+		elapsed := time.Since(start)
+		close(events)
+		t.Log("Flow:", err)
+		if !errors.Is(err, ErrCanceled) {
+			t.Error("errors.Is(err, ErrCanceled) = false; want true")
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Error("errors.Is(err, context.Canceled) = false; want true")
+		}
+		// The first poll happens after 1 second. The next poll would be a minute
+		// later, so Flow must return well before that.
+		if elapsed > 10*time.Second {
+			t.Errorf("Flow took %v to return after cancel", elapsed)
+		}
+	})
+	t.Run("FlowWithTimeout", func(t *testing.T) {
+		opts := startTestServer(t, pendingForever)
+		_, err := FlowWithTimeout(context.Background(), 1500*time.Millisecond, opts)
+		t.Log("FlowWithTimeout:", err)
+		if ie := (*InterruptedError)(nil); !errors.As(err, &ie) || ie.Polls == 0 {
+			t.Error("error is not an InterruptedError recording polls")
+		}
+		if !errors.Is(err, ErrTimeout) {
+			t.Error("errors.Is(err, ErrTimeout) = false; want true")
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Error("errors.Is(err, context.DeadlineExceeded) = false; want true")
+		}
+		if err == nil || !strings.Contains(err.Error(), "1.5s") {
+			t.Error("error does not mention the timeout")
+		}
+	})
+}
+
+func TestFlowDeadline(t *testing.T) {
+	t.Run("Passes", func(t *testing.T) {
+		t.Parallel()
+		opts := startTestServer(t, pendingForever)
+		opts.Deadline = time.Now().Add(1500 * time.Millisecond)
+		start := time.Now()
+		_, err := Flow(context.Background(), opts)
+		t.Log("Flow:", err)
+		if !errors.Is(err, ErrTimeout) {
+			t.Errorf("errors.Is(err, ErrTimeout) = false; want true")
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("Flow took %v; want about 1.5s", elapsed)
+		}
+	})
+	t.Run("AlreadyPassed", func(t *testing.T) {
+		t.Parallel()
+		requested := false
+		opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			requested = true
+			pendingForever(w, r)
+		})
+		opts.Deadline = time.Now().Add(-time.Second)
+		_, err := Flow(context.Background(), opts)
+		if !errors.Is(err, ErrTimeout) {
+			t.Errorf("Flow(...) = _, %v; want error matching ErrTimeout", err)
+		}
+		if requested {
+			t.Error("Flow polled after its deadline")
+		}
+	})
+	t.Run("BeforeFlowWithTimeout", func(t *testing.T) {
+		t.Parallel()
+		opts := startTestServer(t, pendingForever)
+		opts.Deadline = time.Now().Add(1500 * time.Millisecond)
+		_, err := FlowWithTimeout(context.Background(), time.Hour, opts)
+		t.Log("FlowWithTimeout:", err)
+		if !errors.Is(err, ErrTimeout) {
+			t.Errorf("errors.Is(err, ErrTimeout) = false; want true")
+		}
+		if err != nil && strings.Contains(err.Error(), "not authorized within") {
+			t.Error("error blames FlowWithTimeout's timeout instead of opts.Deadline")
+		}
+	})
+	t.Run("ContextEarlier", func(t *testing.T) {
+		t.Parallel()
+		opts := startTestServer(t, pendingForever)
+		opts.Deadline = time.Now().Add(time.Hour)
+		ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := Flow(ctx, opts)
+		if !errors.Is(err, ErrTimeout) {
+			t.Errorf("Flow(...) = _, %v; want error matching ErrTimeout", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("Flow took %v; want about 1.5s", elapsed)
+		}
+	})
+}
+
+func TestFlowEvents(t *testing.T) {
+	t.Parallel()
+	var tokenRequests struct {
+		mu sync.Mutex
+		n  int
+	}
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests.mu.Lock()
+		tokenRequests.n++
+		n := tokenRequests.n
+		tokenRequests.mu.Unlock()
+		w.Header().Set("Content-Type", formMediaType)
+		if n == 1 {
+			io.WriteString(w, "error=slow_down&interval=1")
+			return
+		}
+		io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+	})
+	events := make(chan Event, 100)
+	opts.Events = events
+	if _, err := Flow(context.Background(), opts); err != nil {
+		t.Fatal("Flow:", err)
+	}
+	close(events)
+	var got []EventType
+	for ev := range events {
+		got = append(got, ev.Type)
+	}
+	want := []EventType{
+		DeviceCodeReceived,
+		PromptShown,
+		Polled,
+		SlowDown,
+		Polled,
+		Succeeded,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("events (-want +got):\n%s", diff)
+	}
+
+	t.Run("Logger", func(t *testing.T) {
+		opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", formMediaType)
+			io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+		})
+		logBuf := new(bytes.Buffer)
+		opts.Logger = log.New(logBuf, "", 0)
+		if _, err := Flow(context.Background(), opts); err != nil {
+			t.Fatal("Flow:", err)
+		}
+		logOutput := logBuf.String()
+		t.Logf("Log output:\n%s", logOutput)
+		if !strings.Contains(logOutput, "DED-BEF") {
+			t.Error("Log does not contain user code")
+		}
+		if strings.Contains(logOutput, "xyzzy") {
+			t.Error("Log contains access token")
+		}
+	})
+
+	t.Run("NoReceiver", func(t *testing.T) {
+		opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", formMediaType)
+			io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+		})
+		opts.Events = make(chan Event)
+		if _, err := Flow(context.Background(), opts); err != nil {
+			t.Fatal("Flow:", err)
+		}
+	})
+}
+
+func TestFlowResponse(t *testing.T) {
+	t.Parallel()
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, "access_token=xyzzy&refresh_token=plugh&token_type=bearer&scope=repo&future_field=42")
+	})
+	result, err := RunFlow(context.Background(), opts)
+	if err != nil {
+		t.Fatal("RunFlow:", err)
+	}
+	want := url.Values{
+		"token_type":   {"bearer"},
+		"scope":        {"repo"},
+		"future_field": {"42"},
+	}
+	if diff := cmp.Diff(want, result.Response); diff != "" {
+		t.Errorf("result.Response (-want +got):\n%s", diff)
+	}
+	if result.AccessToken != "xyzzy" {
+		t.Errorf("result.AccessToken = %q; want %q", result.AccessToken, "xyzzy")
+	}
+	if result.IsExpiring() {
+		t.Errorf("result.IsExpiring() = true (ExpiresAt = %v); want false", result.ExpiresAt)
+	}
+	if want := "https://example.com/login/device"; result.VerificationURL != want {
+		t.Errorf("result.VerificationURL = %q; want %q", result.VerificationURL, want)
+	}
+	if want := "https://example.com/login/device?user_code=DED-BEF"; result.VerificationURLComplete != want {
+		t.Errorf("result.VerificationURLComplete = %q; want %q", result.VerificationURLComplete, want)
+	}
+}
+
+func TestStartFlow(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		t.Parallel()
+		opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", formMediaType)
+			io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+		})
+		resultCh, cancel := StartFlow(context.Background(), opts)
+		defer cancel()
+		result := <-resultCh
+		if result.Err != nil {
+			t.Fatal("StartFlow:", result.Err)
+		}
+		if result.AccessToken != "xyzzy" {
+			t.Errorf("result.AccessToken = %q; want %q", result.AccessToken, "xyzzy")
+		}
+		if _, ok := <-resultCh; ok {
+			t.Error("result channel not closed after result")
+		}
+	})
+	t.Run("Cancel", func(t *testing.T) {
+		t.Parallel()
+		opts := startTestServer(t, pendingForever)
+		prompted := make(chan struct{})
+		opts.Prompter = func(context.Context, Prompt) error {
+			close(prompted)
+			return nil
+		}
+		resultCh, cancel := StartFlow(context.Background(), opts)
+		<-prompted
+		cancel()
+		result := <-resultCh
+		t.Log("StartFlow:", result.Err)
+		if !errors.Is(result.Err, ErrCanceled) {
+			t.Errorf("errors.Is(result.Err, ErrCanceled) = false; want true")
+		}
+		if result.AccessToken != "" {
+			t.Errorf("result.AccessToken = %q; want \"\"", result.AccessToken)
+		}
+		cancel()
+	})
+}
+
+func TestFlowRepromptVerificationURLComplete(t *testing.T) {
+	t.Parallel()
+	var codes struct {
+		mu sync.Mutex
+		n  int
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/device/code", func(w http.ResponseWriter, r *http.Request) {
+		codes.mu.Lock()
+		codes.n++
+		userCode := fmt.Sprintf("CODE-%04d", codes.n)
+		codes.mu.Unlock()
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, url.Values{
+			"device_code":               {"xyzzy"},
+			"user_code":                 {userCode},
+			"verification_uri":          {"https://example.com/login/device"},
+			"verification_uri_complete": {"https://example.com/login/device?user_code=" + userCode},
+			"interval":                  {"1"},
+		}.Encode())
+	})
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, "access_token=plugh&token_type=bearer")
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	result, err := RunFlow(context.Background(), Options{
+		ClientID:      "cafe1234",
+		GitHubURL:     u,
+		AllowInsecure: true,
+		HTTPClient:    srv.Client(),
+		Prompter: func(ctx context.Context, p Prompt) error {
+			got = append(got, p.VerificationURLComplete)
+			if len(got) == 1 {
+				return ErrNewCode
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal("RunFlow:", err)
+	}
+	want := []string{
+		"https://example.com/login/device?user_code=CODE-0001",
+		"https://example.com/login/device?user_code=CODE-0002",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("prompted VerificationURLComplete (-want +got):\n%s", diff)
+	}
+	if result.VerificationURLComplete != want[1] {
+		t.Errorf("result.VerificationURLComplete = %q; want %q", result.VerificationURLComplete, want[1])
+	}
+}
+
+func TestFlowOAuthErrorChain(t *testing.T) {
+	for _, statusCode := range []int{http.StatusOK, http.StatusBadRequest} {
+		statusCode := statusCode
+		t.Run(strconv.Itoa(statusCode), func(t *testing.T) {
+			t.Parallel()
+			opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", formMediaType)
+				w.WriteHeader(statusCode)
+				io.WriteString(w, "error=access_denied")
+			})
+			_, err := Flow(context.Background(), opts)
+			t.Log("Flow:", err)
+			var oauthErr *OAuthError
+			for e := err; e != nil && oauthErr == nil; e = errors.Unwrap(e) {
+				oauthErr, _ = e.(*OAuthError)
+			}
+			if oauthErr == nil {
+				t.Fatal("errors.Unwrap chain does not include an *OAuthError")
+			}
+			if !errors.Is(err, ErrAccessDenied) {
+				t.Error("errors.Is(err, ErrAccessDenied) = false; want true")
+			}
+			var httpErr *HTTPError
+			gotHTTPErr := errors.As(err, &httpErr)
+			if statusCode == http.StatusOK {
+				if gotHTTPErr {
+					t.Errorf("errors.As(err, new(*HTTPError)) = true (%v); want false", httpErr)
+				}
+				return
+			}
+			if !gotHTTPErr || httpErr.StatusCode != statusCode {
+				t.Errorf("errors.As(err, new(*HTTPError)) = %t (%v); want status %d", gotHTTPErr, httpErr, statusCode)
+			}
+			if errors.Unwrap(oauthErr) != httpErr {
+				t.Errorf("errors.Unwrap(oauthErr) = %v; want %v", errors.Unwrap(oauthErr), httpErr)
+			}
+		})
+	}
+}
+
+func TestFlowResultInterval(t *testing.T) {
+	t.Run("Initial", func(t *testing.T) {
+		t.Parallel()
+		opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", formMediaType)
+			io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+		})
+		result, err := RunFlow(context.Background(), opts)
+		if err != nil {
+			t.Fatal("RunFlow:", err)
+		}
+		if result.Interval != time.Second {
+			t.Errorf("result.Interval = %v; want %v", result.Interval, time.Second)
+		}
+	})
+	t.Run("SlowDown", func(t *testing.T) {
+		t.Parallel()
+		polls := 0
+		opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", formMediaType)
+			polls++
+			if polls == 1 {
+				io.WriteString(w, "error=slow_down&interval=2")
+				return
+			}
+			io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+		})
+		result, err := RunFlow(context.Background(), opts)
+		if err != nil {
+			t.Fatal("RunFlow:", err)
+		}
+		if result.Interval != 2*time.Second {
+			t.Errorf("result.Interval = %v; want %v", result.Interval, 2*time.Second)
+		}
+	})
+}
+
+func TestFlowExpiringToken(t *testing.T) {
+	t.Parallel()
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, "access_token=xyzzy&expires_in=28800&refresh_token=plugh&refresh_token_expires_in=15811200&token_type=bearer")
+	})
+	start := time.Now()
+	result, err := RunFlow(context.Background(), opts)
+	if err != nil {
+		t.Fatal("RunFlow:", err)
+	}
+	if !result.IsExpiring() {
+		t.Error("result.IsExpiring() = false; want true")
+	}
+	// ExpiresAt may be computed from the Date header,
+	// which is truncated to the second.
+	if earliest, latest := start.Add(8*time.Hour-time.Second), time.Now().Add(8*time.Hour); result.ExpiresAt.Before(earliest) || result.ExpiresAt.After(latest) {
+		t.Errorf("result.ExpiresAt = %v; want between %v and %v", result.ExpiresAt, earliest, latest)
+	}
+	if result.ObtainedAt.Before(start) || result.ObtainedAt.After(time.Now()) {
+		t.Errorf("result.ObtainedAt = %v; want during the flow", result.ObtainedAt)
+	}
+	if result.RefreshToken != "plugh" {
+		t.Errorf("result.RefreshToken = %q; want %q", result.RefreshToken, "plugh")
+	}
+}
+
+func TestParseTokenResponse(t *testing.T) {
+	v := url.Values{
+		"access_token":  {"xyzzy"},
+		"token_type":    {"bearer"},
+		"scope":         {"repo,read:org"},
+		"expires_in":    {"28800"},
+		"refresh_token": {"plugh"},
+	}
+	start := time.Now()
+	result, err := ParseTokenResponse(v)
+	if err != nil {
+		t.Fatal("ParseTokenResponse:", err)
+	}
+	if result.AccessToken != "xyzzy" {
+		t.Errorf("AccessToken = %q; want %q", result.AccessToken, "xyzzy")
+	}
+	if result.TokenType != "bearer" {
+		t.Errorf("TokenType = %q; want %q", result.TokenType, "bearer")
+	}
+	if want := (Scopes{"repo", "read:org"}); !cmp.Equal(result.Scopes, want) {
+		t.Errorf("Scopes = %q; want %q", result.Scopes, want)
+	}
+	if result.RefreshToken != "plugh" {
+		t.Errorf("RefreshToken = %q; want %q", result.RefreshToken, "plugh")
+	}
+	if earliest, latest := start.Add(8*time.Hour), time.Now().Add(8*time.Hour); result.ExpiresAt.Before(earliest) || result.ExpiresAt.After(latest) {
+		t.Errorf("ExpiresAt = %v; want between %v and %v", result.ExpiresAt, earliest, latest)
+	}
+	if want := (url.Values{"token_type": {"bearer"}, "scope": {"repo,read:org"}, "expires_in": {"28800"}}); !cmp.Equal(result.Response, want) {
+		t.Errorf("Response = %v; want %v", result.Response, want)
+	}
+
+	t.Run("Error", func(t *testing.T) {
+		_, err := ParseTokenResponse(url.Values{"error": {"access_denied"}})
+		if !errors.Is(err, ErrAccessDenied) {
+			t.Errorf("ParseTokenResponse(...) = _, %v; want %v", err, ErrAccessDenied)
+		}
+	})
+	t.Run("MissingToken", func(t *testing.T) {
+		if _, err := ParseTokenResponse(url.Values{"token_type": {"bearer"}}); err == nil {
+			t.Error("ParseTokenResponse(...) did not return an error")
+		}
+	})
+}
+
+func TestExchangeTimesIssuedAt(t *testing.T) {
+	sent := time.Date(2020, time.November, 20, 12, 0, 0, 500e6, time.UTC)
+	received := sent.Add(300 * time.Millisecond)
+	tests := []struct {
+		name string
+		date time.Time
+		want time.Time
+	}{
+		{name: "NoDate", want: received},
+		{name: "DateDuringExchange", date: sent.Truncate(time.Second), want: sent.Truncate(time.Second)},
+		{name: "DateBehind", date: sent.Add(-time.Hour), want: received},
+		{name: "DateAhead", date: received.Add(time.Hour), want: received},
+	}
+	for _, test := range tests {
+		times := exchangeTimes{sent: sent, received: received, date: test.date}
+		if got := times.issuedAt(); !got.Equal(test.want) {
+			t.Errorf("%s: issuedAt() = %v; want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWaitForAccessTokenResponse(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		content string
+		want    string // substring of error
+		oauth   string // expected OAuthError code, if any
+	}{
+		{
+			name:    "Error",
+			content: "error=access_denied&error_description=The+user+has+denied+your+application+access.",
+			oauth:   "access_denied",
+		},
+		{
+			name:    "Empty",
+			content: "",
+			want:    "empty response",
+		},
+		{
+			name:    "MissingToken",
+			content: "token_type=bearer&refresh_token=plugh",
+			want:    "token_type=bearer",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", formMediaType)
+				io.WriteString(w, test.content)
+			})
+			var polls int
+			interval := 10 * time.Millisecond
+			_, err := waitForAccessToken(context.Background(), opts, "xyzzy", &interval, &polls, nil)
+			t.Log("waitForAccessToken:", err)
+			if err == nil {
+				t.Fatal("waitForAccessToken did not return an error")
+			}
+			var oauthErr *OAuthError
+			if isOAuth := errors.As(err, &oauthErr); isOAuth != (test.oauth != "") {
+				t.Errorf("errors.As(err, new(*OAuthError)) = %t; want %t", isOAuth, test.oauth != "")
+			} else if isOAuth && oauthErr.Code != test.oauth {
+				t.Errorf("OAuthError.Code = %q; want %q", oauthErr.Code, test.oauth)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error does not contain %q", test.want)
+			}
+			if strings.Contains(err.Error(), "plugh") {
+				t.Error("error contains refresh token")
+			}
+		})
+	}
+}
+
+func TestFlowUserCodeFormatter(t *testing.T) {
+	t.Parallel()
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+	})
+	opts.UserCodeFormatter = func(code string) string {
+		return strings.ReplaceAll(code, "-", "")
+	}
+	var got Prompt
+	opts.Prompter = func(_ context.Context, p Prompt) error {
+		got = p
+		return nil
+	}
+	if _, err := Flow(context.Background(), opts); err != nil {
+		t.Fatal("Flow:", err)
+	}
+	if got.UserCode != "DEDBEF" {
+		t.Errorf("prompt.UserCode = %q; want %q", got.UserCode, "DEDBEF")
+	}
+	if got.RawUserCode != "DED-BEF" {
+		t.Errorf("prompt.RawUserCode = %q; want %q", got.RawUserCode, "DED-BEF")
+	}
+}
+
+func TestFlowPromptResponse(t *testing.T) {
+	t.Parallel()
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+	})
+	var got url.Values
+	opts.Prompter = func(ctx context.Context, p Prompt) error {
+		got = p.Response
+		return nil
+	}
+	if _, err := Flow(context.Background(), opts); err != nil {
+		t.Fatal("Flow:", err)
+	}
+	if got.Get("user_code") != "DED-BEF" || got.Get("expires_in") != "900" {
+		t.Errorf("prompt.Response = %v; want fields from the device code response", got)
+	}
+	if _, ok := got["device_code"]; ok {
+		t.Errorf("prompt.Response includes device_code")
+	}
+}
+
+func TestFlowOnDeviceCode(t *testing.T) {
+	t.Run("BeforePrompt", func(t *testing.T) {
+		t.Parallel()
+		opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", formMediaType)
+			io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+		})
+		var saved *DeviceCode
+		opts.OnDeviceCode = func(ctx context.Context, dc DeviceCode) error {
+			saved = &dc
+			return nil
+		}
+		opts.Prompter = func(ctx context.Context, p Prompt) error {
+			if saved == nil {
+				t.Error("Prompter called before OnDeviceCode")
+			} else if saved.UserCode != p.RawUserCode {
+				t.Errorf("OnDeviceCode user code = %q; prompt's is %q", saved.UserCode, p.RawUserCode)
+			}
+			return nil
+		}
+		if _, err := Flow(context.Background(), opts); err != nil {
+			t.Fatal("Flow:", err)
+		}
+		if saved == nil {
+			t.Fatal("OnDeviceCode not called")
+		}
+		if want := "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"; saved.DeviceCode != want {
+			t.Errorf("dc.DeviceCode = %q; want %q", saved.DeviceCode, want)
+		}
+	})
+	t.Run("Error", func(t *testing.T) {
+		t.Parallel()
+		opts := startTestServer(t, pendingForever)
+		errSave := errors.New("disk full")
+		opts.OnDeviceCode = func(ctx context.Context, dc DeviceCode) error {
+			return errSave
+		}
+		opts.Prompter = func(ctx context.Context, p Prompt) error {
+			t.Error("Prompter called after OnDeviceCode failed")
+			return nil
+		}
+		_, err := Flow(context.Background(), opts)
+		if !errors.Is(err, errSave) {
+			t.Errorf("Flow(...) = _, %v; want error wrapping %v", err, errSave)
+		}
+	})
+}
+
+func TestFlowPromptRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		retries   int
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "Default", retries: 0, wantCalls: 1, wantErr: true},
+		{name: "TooFew", retries: 1, wantCalls: 2, wantErr: true},
+		{name: "Enough", retries: 2, wantCalls: 3, wantErr: false},
+		{name: "Extra", retries: 5, wantCalls: 3, wantErr: false},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", formMediaType)
+				io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+			})
+			opts.PromptRetries = test.retries
+			errBrowser := errors.New("could not open browser")
+			calls := 0
+			opts.Prompter = func(ctx context.Context, p Prompt) error {
+				calls++
+				if calls < 3 {
+					return errBrowser
+				}
+				return nil
+			}
+			result, err := RunFlow(context.Background(), opts)
+			if calls != test.wantCalls {
+				t.Errorf("Prompter called %d times; want %d", calls, test.wantCalls)
+			}
+			if result.Prompts != test.wantCalls {
+				t.Errorf("result.Prompts = %d; want %d", result.Prompts, test.wantCalls)
+			}
+			if test.wantErr {
+				if !errors.Is(err, errBrowser) {
+					t.Errorf("RunFlow(...) = _, %v; want error wrapping %v", err, errBrowser)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("RunFlow:", err)
+			}
+			if result.AccessToken != "xyzzy" {
+				t.Errorf("result.AccessToken = %q; want %q", result.AccessToken, "xyzzy")
+			}
+		})
+	}
+}
+
+func TestFlowOnToken(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		t.Parallel()
+		opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", formMediaType)
+			io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+		})
+		var got []FlowResult
+		opts.OnToken = func(ctx context.Context, result FlowResult) error {
+			got = append(got, result)
+			return nil
+		}
+		token, err := Flow(context.Background(), opts)
+		if err != nil {
+			t.Fatal("Flow:", err)
+		}
+		if len(got) != 1 {
+			t.Fatalf("OnToken called %d times; want 1", len(got))
+		}
+		if got[0].AccessToken != token {
+			t.Errorf("OnToken result.AccessToken = %q; want %q", got[0].AccessToken, token)
+		}
+	})
+	t.Run("Error", func(t *testing.T) {
+		t.Parallel()
+		opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", formMediaType)
+			io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+		})
+		errSave := errors.New("disk full")
+		opts.OnToken = func(ctx context.Context, result FlowResult) error {
+			return errSave
+		}
+		result, err := RunFlow(context.Background(), opts)
+		if !errors.Is(err, errSave) {
+			t.Errorf("RunFlow(...) = _, %v; want error wrapping %v", err, errSave)
+		}
+		if result.AccessToken != "xyzzy" {
+			t.Errorf("result.AccessToken = %q; want %q so the token can be revoked", result.AccessToken, "xyzzy")
+		}
+		if token, err := Flow(context.Background(), opts); !errors.Is(err, errSave) || token != "" {
+			t.Errorf("Flow(...) = %q, %v; want \"\", error wrapping %v", token, err, errSave)
+		}
+	})
+}
+
+func TestFlowDryRun(t *testing.T) {
+	t.Parallel()
+	polled := make(chan struct{}, 1)
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case polled <- struct{}{}:
+		default:
+		}
+		pendingForever(w, r)
+	})
+	opts.DryRun = true
+	prompts := 0
+	opts.Prompter = func(context.Context, Prompt) error {
+		prompts++
+		return nil
+	}
+	result, err := RunFlow(context.Background(), opts)
+	t.Log("RunFlow:", err)
+	if !errors.Is(err, ErrDryRun) {
+		t.Error("errors.Is(err, ErrDryRun) = false; want true")
+	}
+	if prompts != 1 {
+		t.Errorf("Prompter called %d times; want 1", prompts)
+	}
+	if result.Polls != 0 {
+		t.Errorf("result.Polls = %d; want 0", result.Polls)
+	}
+	select {
+	case <-polled:
+		t.Error("Access token endpoint was polled")
+	default:
+	}
+}
+
+func TestFlowPollLimits(t *testing.T) {
+	t.Parallel()
+	t.Run("MaxInterval", func(t *testing.T) {
+		t.Parallel()
+		var tokenRequests struct {
+			mu sync.Mutex
+			n  int
+		}
+		opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			tokenRequests.mu.Lock()
+			tokenRequests.n++
+			n := tokenRequests.n
+			tokenRequests.mu.Unlock()
+			w.Header().Set("Content-Type", formMediaType)
+			if n <= 2 {
+				io.WriteString(w, "error=slow_down&interval=60")
+				return
+			}
+			io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+		})
+		const maxInterval = 2 * time.Second
+		opts.MaxInterval = maxInterval
+		events := make(chan Event, 100)
+		opts.Events = events
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := Flow(ctx, opts); err != nil {
+			t.Fatal("Flow:", err)
+		}
+		close(events)
+		var got []time.Duration
+		for ev := range events {
+			if ev.Type == SlowDown {
+				got = append(got, ev.Interval)
+			}
+		}
+		want := []time.Duration{maxInterval, maxInterval}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("SlowDown intervals (-want +got):\n%s", diff)
+		}
+	})
+	t.Run("InitialDelay", func(t *testing.T) {
+		t.Parallel()
+		var firstPoll struct {
+			mu sync.Mutex
+			t  time.Time
+		}
+		opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			firstPoll.mu.Lock()
+			if firstPoll.t.IsZero() {
+				firstPoll.t = time.Now()
+			}
+			firstPoll.mu.Unlock()
+			w.Header().Set("Content-Type", formMediaType)
+			io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+		})
+		const initialDelay = 1500 * time.Millisecond
+		opts.InitialDelay = initialDelay
+		var prompted time.Time
+		opts.Prompter = func(context.Context, Prompt) error {
+			prompted = time.Now()
+			return nil
+		}
+		if _, err := Flow(context.Background(), opts); err != nil {
+			t.Fatal("Flow:", err)
+		}
+		firstPoll.mu.Lock()
+		wait := firstPoll.t.Sub(prompted)
+		firstPoll.mu.Unlock()
+		if wait < initialDelay {
+			t.Errorf("first poll %v after prompt; want at least %v", wait, initialDelay)
+		}
+	})
+	t.Run("PendingBackoff", func(t *testing.T) {
+		t.Parallel()
+		var tokenRequests struct {
+			mu sync.Mutex
+			n  int
+		}
+		opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			tokenRequests.mu.Lock()
+			tokenRequests.n++
+			n := tokenRequests.n
+			tokenRequests.mu.Unlock()
+			w.Header().Set("Content-Type", formMediaType)
+			if n <= 6 {
+				io.WriteString(w, "error=authorization_pending")
+				return
+			}
+			io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+		})
+		opts.PendingBackoff = 2
+		opts.MaxInterval = 40 * time.Millisecond
+		var polls int
+		interval := 10 * time.Millisecond
+		if _, err := waitForAccessToken(context.Background(), opts, "xyzzy", &interval, &polls, nil); err != nil {
+			t.Fatal("waitForAccessToken:", err)
+		}
+		if polls != 7 {
+			t.Errorf("polls = %d; want 7", polls)
+		}
+		// 10ms doubles after 2 pending responses and again after 4,
+		// then stays at MaxInterval.
+		if interval != 40*time.Millisecond {
+			t.Errorf("interval = %v; want 40ms", interval)
+		}
+	})
+	t.Run("MaxIntervalBelowInitial", func(t *testing.T) {
+		t.Parallel()
+		var tokenRequests struct {
+			mu    sync.Mutex
+			times []time.Time
+		}
+		opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			tokenRequests.mu.Lock()
+			tokenRequests.times = append(tokenRequests.times, time.Now())
+			n := len(tokenRequests.times)
+			tokenRequests.mu.Unlock()
+			w.Header().Set("Content-Type", formMediaType)
+			if n == 1 {
+				io.WriteString(w, "error=slow_down&interval=60")
+				return
+			}
+			io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+		})
+		// The server's interval is 1 second. MaxInterval must not make the
+		// flow poll more often than that.
+		opts.MaxInterval = 100 * time.Millisecond
+		events := make(chan Event, 100)
+		opts.Events = events
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		start := time.Now()
+		if _, err := Flow(ctx, opts); err != nil {
+			t.Fatal("Flow:", err)
+		}
+		close(events)
+		for ev := range events {
+			if ev.Type == SlowDown && ev.Interval != time.Second {
+				t.Errorf("SlowDown interval = %v; want 1s", ev.Interval)
+			}
+		}
+		tokenRequests.mu.Lock()
+		times := tokenRequests.times
+		tokenRequests.mu.Unlock()
+		if len(times) != 2 {
+			t.Fatalf("%d token requests; want 2", len(times))
+		}
+		if d := times[0].Sub(start); d < 900*time.Millisecond {
+			t.Errorf("first poll after %v; want >=1s", d)
+		}
+		if d := times[1].Sub(times[0]); d < 900*time.Millisecond {
+			t.Errorf("second poll %v after first; want >=1s", d)
+		}
+	})
+	t.Run("MaxPolls", func(t *testing.T) {
+		t.Parallel()
+		opts := startTestServer(t, pendingForever)
+		opts.MaxPolls = 3
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		start := time.Now()
+		result, err := RunFlow(ctx, opts)
+		elapsed := time.Since(start)
+		t.Log("RunFlow:", err)
+		if !errors.Is(err, ErrTooManyPolls) {
+			t.Error("errors.Is(err, ErrTooManyPolls) = false; want true")
+		}
+		if result.Polls != opts.MaxPolls {
+			t.Errorf("result.Polls = %d; want %d", result.Polls, opts.MaxPolls)
+		}
+		// The test server's interval is 1s, so the last poll is made after
+		// about 3s. The flow should not wait another interval after it.
+		if max := time.Duration(opts.MaxPolls)*time.Second + 500*time.Millisecond; elapsed > max {
+			t.Errorf("RunFlow took %v; want at most %v", elapsed, max)
+		}
+	})
+}
+
+func TestFlowSemaphore(t *testing.T) {
+	t.Parallel()
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+	})
+	opts.Semaphore = make(chan struct{}, 1)
+
+	// Start a flow that holds the semaphore until release is closed.
+	release := make(chan struct{})
+	firstPrompted := make(chan struct{})
+	firstOpts := opts
+	firstOpts.Prompter = func(ctx context.Context, p Prompt) error {
+		close(firstPrompted)
+		<-release
+		return nil
+	}
+	firstDone := make(chan error, 1)
+	go func() {
+		_, err := Flow(context.Background(), firstOpts)
+		firstDone <- err
+	}()
+	<-firstPrompted
+
+	secondPrompted := make(chan struct{})
+	secondOpts := opts
+	secondOpts.Prompter = func(ctx context.Context, p Prompt) error {
+		close(secondPrompted)
+		return nil
+	}
+	secondDone := make(chan error, 1)
+	go func() {
+		_, err := Flow(context.Background(), secondOpts)
+		secondDone <- err
+	}()
+	select {
+	case <-secondPrompted:
+		t.Fatal("Second flow started while first flow held the semaphore")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-firstDone; err != nil {
+		t.Error("First flow:", err)
+	}
+	if err := <-secondDone; err != nil {
+		t.Error("Second flow:", err)
+	}
+
+	t.Run("Canceled", func(t *testing.T) {
+		opts := startTestServer(t, pendingForever)
+		opts.Semaphore = make(chan struct{}, 1)
+		opts.Semaphore <- struct{}{}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := Flow(ctx, opts)
+		t.Log("Flow:", err)
+		if !errors.Is(err, ErrTimeout) {
+			t.Error("errors.Is(err, ErrTimeout) = false; want true")
+		}
+	})
+}
+
+func TestFlowBlockingPrompter(t *testing.T) {
+	t.Parallel()
+	var firstPoll struct {
+		mu sync.Mutex
+		t  time.Time
+	}
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		firstPoll.mu.Lock()
+		if firstPoll.t.IsZero() {
+			firstPoll.t = time.Now()
+		}
+		firstPoll.mu.Unlock()
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+	})
+	var acked time.Time
+	opts.Prompter = func(ctx context.Context, p Prompt) error {
+		// Simulate waiting for the user to click a button.
+		select {
+		case <-time.After(1500 * time.Millisecond):
+			acked = time.Now()
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if _, err := Flow(context.Background(), opts); err != nil {
+		t.Fatal("Flow:", err)
+	}
+	firstPoll.mu.Lock()
+	defer firstPoll.mu.Unlock()
+	if firstPoll.t.Before(acked) {
+		t.Errorf("first poll at %v, before prompt was acknowledged at %v", firstPoll.t, acked)
+	}
+}
+
+// startTestServer starts a server that issues device codes with a one second
+// polling interval and answers access token requests with the given handler.
+// It returns Options configured to use the server with a no-op prompter.
+func startTestServer(t *testing.T, accessToken http.HandlerFunc) Options {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/device/code", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, url.Values{
+			"device_code":               {"xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"},
+			"user_code":                 {"DED-BEF"},
+			"verification_uri":          {"https://example.com/login/device"},
+			"verification_uri_complete": {"https://example.com/login/device?user_code=DED-BEF"},
+			"expires_in":                {"900"},
+			"interval":                  {"1"},
+		}.Encode())
+	})
+	mux.Handle("/login/oauth/access_token", accessToken)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Options{
+		ClientID:      "cafe1234",
+		GitHubURL:     u,
+		AllowInsecure: true,
+		HTTPClient:    srv.Client(),
+		Prompter: func(context.Context, Prompt) error {
+			return nil
+		},
+	}
+}
+
+// pendingForever is an access token handler that never finishes authorization.
+func pendingForever(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", formMediaType)
+	io.WriteString(w, "error=authorization_pending")
+}
+
+func TestPromptString(t *testing.T) {
+	p := Prompt{
+		VerificationURL: "https://example.com/login/device",
+		UserCode:        "DED-BEF",
+	}
+	const want = "enter DED-BEF at https://example.com/login/device"
+	if got := p.String(); got != want {
+		t.Errorf("Prompt.String() = %q; want %q", got, want)
+	}
+}
+
+func TestPost(t *testing.T) {
+	t.Run("Request", func(t *testing.T) {
+		const userAgent = "me 1.2.3"
+		const apiVersionHeader = "X-Github-Api-Version"
+		const requestID = "trace-5678"
+		var firstRequest sync.Once
+		want := url.Values{
+			"foo": {"bar"},
+			"baz": {"quux"},
+		}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			first := false
+			firstRequest.Do(func() {
+				first = true
+				if r.Method != http.MethodPost {
+					t.Errorf("method = %q; want %q", r.Method, http.MethodPost)
+				}
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					t.Error("Read request body:", err)
+					return
+				}
+				if got := r.Header.Get("Content-Type"); got != formMediaType {
+					t.Errorf("Content-Type = %q; want %q", want, formMediaType)
+				}
+				if got := r.Header.Get("Accept"); got != formMediaType {
+					t.Errorf("Accept = %q; want %q", want, formMediaType)
+				}
+				if got := r.Header.Get("User-Agent"); got != userAgent {
+					t.Errorf("User-Agent = %q; want %q", got, userAgent)
+				}
+				if got := r.Header.Get(RequestIDHeader); got != requestID {
+					t.Errorf("%s = %q; want %q", RequestIDHeader, got, requestID)
+				}
+				if got, want := r.Header.Get(apiVersionHeader), "2022-11-28"; got != want {
+					t.Errorf("%s = %q; want %q", apiVersionHeader, got, want)
+				}
+				got, err := url.ParseQuery(string(body))
+				if err != nil {
+					t.Error("Parse request body:", err)
+				}
+				if diff := cmp.Diff(want, got); diff != "" {
+					t.Errorf("body values (-want +got):\n%s", diff)
+				}
+			})
+			if !first {
+				const msg = "Multiple requests to endpoint"
+				t.Error(msg)
+				http.Error(w, msg, http.StatusUnprocessableEntity)
+				return
+			}
+			w.Header().Set("Content-Type", formMediaType)
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusOK)
+		}))
+		t.Cleanup(srv.Close)
+
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := WithRequestID(context.Background(), requestID)
+		opts := Options{
+			HTTPClient:    srv.Client(),
+			UserAgent:     userAgent,
+			AllowInsecure: true,
+			Header: http.Header{
+				apiVersionHeader: {"2022-11-28"},
+				// Headers set by post must not be overridden.
+				"Accept":     {"text/plain"},
+				"User-Agent": {"other"},
+			},
+		}
+		_, err = post(ctx, opts, u, want, FormatForm)
+		if err != nil {
+			t.Error("post:", err)
+		}
+		received := true
+		firstRequest.Do(func() { received = false })
+		if !received {
+			t.Error("Request never sent")
+		}
+	})
+
 	t.Run("Request/Empty", func(t *testing.T) {
 		var firstRequest sync.Once
 		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -341,8 +1918,14 @@ func TestPost(t *testing.T) {
 					t.Error("Read request body:", err)
 					return
 				}
-				if got := r.Header.Get("User-Agent"); got == "" {
-					t.Error("User-Agent empty")
+				if got := r.Header.Get("User-Agent"); got != defaultUserAgent {
+					t.Errorf("User-Agent = %q; want %q", got, defaultUserAgent)
+				}
+				if got := r.Header.Get("User-Agent"); !strings.HasPrefix(got, "ghdevice/") {
+					t.Errorf("User-Agent = %q; want to start with \"ghdevice/\"", got)
+				}
+				if got := r.Header.Get(RequestIDHeader); got != "" {
+					t.Errorf("%s = %q; want \"\"", RequestIDHeader, got)
 				}
 				if len(body) > 0 {
 					t.Errorf("body = %q; want \"\"", body)
@@ -359,19 +1942,232 @@ func TestPost(t *testing.T) {
 			w.WriteHeader(http.StatusOK)
 		}))
 		t.Cleanup(srv.Close)
-
+
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = post(context.Background(), Options{HTTPClient: srv.Client(), AllowInsecure: true}, u, nil, FormatForm)
+		if err != nil {
+			t.Error("post:", err)
+		}
+		received := true
+		firstRequest.Do(func() { received = false })
+		if !received {
+			t.Error("Request never sent")
+		}
+	})
+
+	t.Run("TLSClientConfig", func(t *testing.T) {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", formMediaType)
+			io.WriteString(w, "foo=bar")
+		}))
+		t.Cleanup(srv.Close)
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(srv.Certificate())
+		opts, done := Options{
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}.withTLSClient()
+		defer done()
+		got, err := post(context.Background(), opts, u, nil, FormatForm)
+		if err != nil {
+			t.Fatal("post:", err)
+		}
+		if want := (url.Values{"foo": {"bar"}}); !cmp.Equal(want, got) {
+			t.Errorf("post(...) = %v; want %v", got, want)
+		}
+	})
+
+	t.Run("Gzip", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", formMediaType)
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			io.WriteString(zw, "foo=bar&baz=quux")
+			if err := zw.Close(); err != nil {
+				t.Error("Write response:", err)
+			}
+		}))
+		t.Cleanup(srv.Close)
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := url.Values{
+			"foo": {"bar"},
+			"baz": {"quux"},
+		}
+		for _, disableCompression := range []bool{false, true} {
+			client := srv.Client()
+			transport := client.Transport.(*http.Transport).Clone()
+			transport.DisableCompression = disableCompression
+			client.Transport = transport
+			got, err := post(context.Background(), Options{HTTPClient: client, AllowInsecure: true}, u, nil, FormatForm)
+			if err != nil {
+				t.Errorf("DisableCompression=%t: post: %v", disableCompression, err)
+				continue
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("DisableCompression=%t: post(...) = (-want +got):\n%s", disableCompression, diff)
+			}
+		}
+	})
+
+	t.Run("GzipTooLarge", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", formMediaType)
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			io.WriteString(zw, "foo=")
+			io.WriteString(zw, strings.Repeat("x", 2*maxResponseSize))
+			if err := zw.Close(); err != nil {
+				t.Error("Write response:", err)
+			}
+		}))
+		t.Cleanup(srv.Close)
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := srv.Client()
+		transport := client.Transport.(*http.Transport).Clone()
+		transport.DisableCompression = true
+		client.Transport = transport
+		got, err := post(context.Background(), Options{HTTPClient: client, AllowInsecure: true}, u, nil, FormatForm)
+		if err == nil {
+			t.Fatalf("post(...) = %d fields, <nil>; want error", len(got))
+		}
+		t.Log("post:", err)
+		if !strings.Contains(err.Error(), "larger than") {
+			t.Errorf("error does not report the response size")
+		}
+	})
+
+	t.Run("ConnectionReuse", func(t *testing.T) {
+		var conns struct {
+			mu sync.Mutex
+			n  int
+		}
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Respond with a type that post rejects without reading the body.
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, strings.Repeat("Not a form. ", 40000))
+		}))
+		srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				conns.mu.Lock()
+				conns.n++
+				conns.mu.Unlock()
+			}
+		}
+		srv.Start()
+		t.Cleanup(srv.Close)
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := Options{HTTPClient: srv.Client(), AllowInsecure: true}
+		for i := 0; i < 3; i++ {
+			if _, err := post(context.Background(), opts, u, nil, FormatForm); err == nil {
+				t.Fatal("post did not return an error")
+			}
+		}
+		conns.mu.Lock()
+		n := conns.n
+		conns.mu.Unlock()
+		if n != 1 {
+			t.Errorf("opened %d connections; want 1", n)
+		}
+	})
+
+	t.Run("Redirect", func(t *testing.T) {
+		var otherRequests struct {
+			mu sync.Mutex
+			n  int
+		}
+		other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			otherRequests.mu.Lock()
+			otherRequests.n++
+			otherRequests.mu.Unlock()
+			w.Header().Set("Content-Type", formMediaType)
+			io.WriteString(w, "foo=bar")
+		}))
+		t.Cleanup(other.Close)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/same", func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/target", http.StatusTemporaryRedirect)
+		})
+		mux.HandleFunc("/other", func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, other.URL+"/target", http.StatusTemporaryRedirect)
+		})
+		mux.HandleFunc("/target", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", formMediaType)
+			io.WriteString(w, "foo=bar")
+		})
+		srv := httptest.NewServer(mux)
+		t.Cleanup(srv.Close)
 		u, err := url.Parse(srv.URL)
 		if err != nil {
 			t.Fatal(err)
 		}
-		_, err = post(context.Background(), srv.Client(), "", u, nil)
+		opts := Options{HTTPClient: srv.Client(), AllowInsecure: true}
+
+		if _, err := post(context.Background(), opts, u.ResolveReference(&url.URL{Path: "/same"}), nil, FormatForm); err != nil {
+			t.Error("Same host:", err)
+		}
+		_, err = post(context.Background(), opts, u.ResolveReference(&url.URL{Path: "/other"}), nil, FormatForm)
+		t.Log("Other host:", err)
+		if !errors.Is(err, ErrRedirect) {
+			t.Error("Other host: errors.Is(err, ErrRedirect) = false; want true")
+		}
+		otherRequests.mu.Lock()
+		n := otherRequests.n
+		otherRequests.mu.Unlock()
+		if n != 0 {
+			t.Errorf("Other host received %d requests; want 0", n)
+		}
+		opts.NoRedirects = true
+		_, err = post(context.Background(), opts, u.ResolveReference(&url.URL{Path: "/same"}), nil, FormatForm)
+		t.Log("NoRedirects:", err)
+		if !errors.Is(err, ErrRedirect) {
+			t.Error("NoRedirects: errors.Is(err, ErrRedirect) = false; want true")
+		}
+	})
+
+	t.Run("Deprecation", func(t *testing.T) {
+		const sunset = "Sat, 31 Dec 2050 23:59:59 GMT"
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Sunset", sunset)
+			w.Header().Set("Content-Type", formMediaType)
+			io.WriteString(w, "foo=bar")
+		}))
+		t.Cleanup(srv.Close)
+		u, err := url.Parse(srv.URL)
 		if err != nil {
+			t.Fatal(err)
+		}
+		logBuf := new(bytes.Buffer)
+		opts := Options{
+			HTTPClient:    srv.Client(),
+			Logger:        log.New(logBuf, "", 0),
+			AllowInsecure: true,
+		}
+		if _, err := post(context.Background(), opts, u, nil, FormatForm); err != nil {
 			t.Error("post:", err)
 		}
-		received := true
-		firstRequest.Do(func() { received = false })
-		if !received {
-			t.Error("Request never sent")
+		logOutput := logBuf.String()
+		t.Logf("Log output:\n%s", logOutput)
+		if !strings.Contains(logOutput, "deprecated") {
+			t.Error("Log does not mention deprecation")
+		}
+		if !strings.Contains(logOutput, sunset) {
+			t.Error("Log does not mention sunset date")
 		}
 	})
 
@@ -381,6 +2177,8 @@ func TestPost(t *testing.T) {
 			statusCode  int
 			contentType string
 			content     string
+			chunked     bool
+			lenient     bool
 			want        url.Values
 			wantErr     func(error) bool
 		}{
@@ -400,14 +2198,82 @@ func TestPost(t *testing.T) {
 					"baz": {"quux"},
 				},
 			},
+			{
+				name:        "BareContentType",
+				statusCode:  http.StatusOK,
+				contentType: formMediaType,
+				content:     "foo=bar",
+				want: url.Values{
+					"foo": {"bar"},
+				},
+			},
+			{
+				name:        "Chunked",
+				statusCode:  http.StatusOK,
+				contentType: formMediaType + "; charset=utf-8",
+				content:     "foo=bar&baz=quux",
+				chunked:     true,
+				want: url.Values{
+					"foo": {"bar"},
+					"baz": {"quux"},
+				},
+			},
+			{
+				name:       "EmptyWithoutContentType",
+				statusCode: http.StatusOK,
+				want:       url.Values{},
+			},
+			{
+				name:       "MissingContentType",
+				statusCode: http.StatusOK,
+				content:    "foo=bar",
+				wantErr: func(e error) bool {
+					var oerr *OAuthError
+					return !errors.As(e, &oerr)
+				},
+			},
+			{
+				name:       "MissingContentType/Lenient",
+				statusCode: http.StatusOK,
+				content:    "foo=bar",
+				lenient:    true,
+				want:       url.Values{"foo": {"bar"}},
+			},
+			{
+				name:       "MissingContentType/Lenient/Error",
+				statusCode: http.StatusBadRequest,
+				content:    "error=authorization_pending",
+				lenient:    true,
+				wantErr: func(e error) bool {
+					var oerr *OAuthError
+					return errors.As(e, &oerr) && oerr.Code == "authorization_pending"
+				},
+			},
+			{
+				name:       "MissingContentType/Lenient/ServerError",
+				statusCode: http.StatusInternalServerError,
+				content:    "error=authorization_pending",
+				lenient:    true,
+				wantErr: func(e error) bool {
+					var oerr *OAuthError
+					return !errors.As(e, &oerr)
+				},
+			},
 			{
 				name:        "JSON",
 				statusCode:  http.StatusOK,
 				contentType: "application/json; charset=utf-8",
 				content:     `{"foo":"bar"}`,
+				want:        url.Values{"foo": {"bar"}},
+			},
+			{
+				name:        "JSONError",
+				statusCode:  http.StatusBadRequest,
+				contentType: "application/json; charset=utf-8",
+				content:     `{"error":"slow_down","interval":10}`,
 				wantErr: func(e error) bool {
-					var oerr *oauthError
-					return !errors.As(e, &oerr)
+					var oerr *OAuthError
+					return errors.As(e, &oerr) && oerr.Code == "slow_down" && oerr.RetryAfter == 10*time.Second
 				},
 			},
 			{
@@ -416,21 +2282,173 @@ func TestPost(t *testing.T) {
 				contentType: "text/plain; charset=utf-8",
 				content:     "Bork bork",
 				wantErr: func(e error) bool {
-					var oerr *oauthError
+					var oerr *OAuthError
 					return !errors.As(e, &oerr)
 				},
 			},
+			{
+				name:        "BadGateway",
+				statusCode:  http.StatusBadGateway,
+				contentType: "text/plain; charset=utf-8",
+				content:     "upstream unavailable",
+				wantErr: func(e error) bool {
+					var herr *HTTPError
+					return errors.As(e, &herr) &&
+						herr.StatusCode == http.StatusBadGateway &&
+						herr.Status == "502 Bad Gateway" &&
+						strings.HasPrefix(herr.URL, "http://")
+				},
+			},
+			{
+				name:        "CaptivePortal",
+				statusCode:  http.StatusOK,
+				contentType: "text/html; charset=utf-8",
+				content:     "<!DOCTYPE html><title>Sign in to Wi-Fi</title>",
+				wantErr: func(e error) bool {
+					msg := e.Error()
+					return strings.Contains(msg, "200 OK") && strings.Contains(msg, "proxy")
+				},
+			},
+			{
+				name:        "NetworkAuthenticationRequired",
+				statusCode:  http.StatusNetworkAuthenticationRequired,
+				contentType: "text/html; charset=utf-8",
+				content:     "<!DOCTYPE html><title>Sign in to Wi-Fi</title>",
+				wantErr: func(e error) bool {
+					return strings.Contains(e.Error(), "captive portal")
+				},
+			},
+			{
+				name:        "HTMLNotFound",
+				statusCode:  http.StatusNotFound,
+				contentType: "text/html; charset=utf-8",
+				content:     "<!DOCTYPE html><title>Page not found</title>",
+				wantErr: func(e error) bool {
+					var herr *HTTPError
+					return errors.As(e, &herr) &&
+						herr.StatusCode == http.StatusNotFound &&
+						!strings.Contains(e.Error(), "captive portal")
+				},
+			},
+			{
+				name:        "ProxyAuthenticationRequired",
+				statusCode:  http.StatusProxyAuthRequired,
+				contentType: "text/plain; charset=utf-8",
+				content:     "Proxy login required",
+				wantErr: func(e error) bool {
+					msg := e.Error()
+					var herr *HTTPError
+					return strings.Contains(msg, "407 Proxy Authentication Required") &&
+						strings.Contains(msg, "proxy requires authentication") &&
+						errors.As(e, &herr) && herr.StatusCode == http.StatusProxyAuthRequired
+				},
+			},
 			{
 				name:        "AuthorizationPending",
 				statusCode:  http.StatusBadRequest,
 				contentType: formMediaType + "; charset=utf-8",
 				content:     "error=authorization_pending&error_description=Waiting+for+input",
 				wantErr: func(e error) bool {
-					var oerr *oauthError
+					var oerr *OAuthError
+					if !errors.As(e, &oerr) {
+						return false
+					}
+					return oerr.Code == "authorization_pending" && oerr.Description == "Waiting for input"
+				},
+			},
+			{
+				name:        "ErrorURI",
+				statusCode:  http.StatusBadRequest,
+				contentType: formMediaType + "; charset=utf-8",
+				content:     "error=device_flow_disabled&error_description=Device+flow+must+be+enabled&error_uri=https%3A%2F%2Fdocs.github.com%2Fdevice-flow",
+				wantErr: func(e error) bool {
+					var oerr *OAuthError
+					if !errors.As(e, &oerr) {
+						return false
+					}
+					return oerr.Code == "device_flow_disabled" && oerr.URI == "https://docs.github.com/device-flow"
+				},
+			},
+			{
+				name:        "EncodedDescription",
+				statusCode:  http.StatusBadRequest,
+				contentType: formMediaType + "; charset=utf-8",
+				content:     "error=access_denied&error_description=The%2Buser%2Bhas%2Bdenied%250D%250Ayour%2Bapplication%2Baccess.",
+				wantErr: func(e error) bool {
+					var oerr *OAuthError
+					if !errors.As(e, &oerr) {
+						return false
+					}
+					return oerr.Description == "The user has denied your application access."
+				},
+			},
+			{
+				name:        "PlusInDescription",
+				statusCode:  http.StatusBadRequest,
+				contentType: formMediaType + "; charset=utf-8",
+				content:     "error=access_denied&error_description=C%2B%2B",
+				wantErr: func(e error) bool {
+					var oerr *OAuthError
+					if !errors.As(e, &oerr) {
+						return false
+					}
+					return oerr.Description == "C++"
+				},
+			},
+			{
+				name:        "PercentInDescription",
+				statusCode:  http.StatusBadRequest,
+				contentType: formMediaType + "; charset=utf-8",
+				content:     "error=access_denied&error_description=100%25",
+				wantErr: func(e error) bool {
+					var oerr *OAuthError
+					if !errors.As(e, &oerr) {
+						return false
+					}
+					return oerr.Description == "100%"
+				},
+			},
+			{
+				name:        "MultilineDescription",
+				statusCode:  http.StatusBadRequest,
+				contentType: formMediaType + "; charset=utf-8",
+				content:     "error=access_denied&error_description=The+user+has+denied%0D%0A+your+application%09access.%00",
+				wantErr: func(e error) bool {
+					var oerr *OAuthError
 					if !errors.As(e, &oerr) {
 						return false
 					}
-					return oerr.code == "authorization_pending" && oerr.description == "Waiting for input"
+					return oerr.Description == "The user has denied your application access."
+				},
+			},
+			{
+				name:        "DeviceFlowDisabled",
+				statusCode:  http.StatusBadRequest,
+				contentType: formMediaType + "; charset=utf-8",
+				content:     "error=device_flow_disabled&error_description=Device+flow+must+be+enabled",
+				wantErr: func(e error) bool {
+					return errors.Is(e, ErrDeviceFlowDisabled) &&
+						!errors.Is(e, ErrAccessDenied) &&
+						strings.Contains(e.Error(), "enable device flow")
+				},
+			},
+			{
+				name:        "InvalidGrant",
+				statusCode:  http.StatusBadRequest,
+				contentType: formMediaType + "; charset=utf-8",
+				content:     "error=invalid_grant",
+				wantErr: func(e error) bool {
+					return errors.Is(e, ErrInvalidGrant) &&
+						strings.Contains(e.Error(), "already been used")
+				},
+			},
+			{
+				name:        "AccessDenied",
+				statusCode:  http.StatusBadRequest,
+				contentType: formMediaType + "; charset=utf-8",
+				content:     "error=access_denied&error_description=User+clicked+cancel",
+				wantErr: func(e error) bool {
+					return errors.Is(e, ErrAccessDenied)
 				},
 			},
 			{
@@ -439,20 +2457,31 @@ func TestPost(t *testing.T) {
 				contentType: formMediaType + "; charset=utf-8",
 				content:     "error=slow_down&error_description=Too+many+requests&interval=10",
 				wantErr: func(e error) bool {
-					var oerr *oauthError
+					var oerr *OAuthError
 					if !errors.As(e, &oerr) {
 						return false
 					}
-					return oerr.code == "slow_down" && oerr.description == "Too many requests" && oerr.interval == 10*time.Second
+					return oerr.Code == "slow_down" && oerr.Description == "Too many requests" && oerr.RetryAfter == 10*time.Second
 				},
 			},
 		}
 		for _, test := range tests {
 			t.Run(test.name, func(t *testing.T) {
 				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					w.Header().Set("Content-Type", test.contentType)
-					w.Header().Set("Content-Length", strconv.Itoa(len(test.content)))
+					if test.contentType != "" {
+						w.Header().Set("Content-Type", test.contentType)
+					} else {
+						// Suppress Content-Type sniffing.
+						w.Header()["Content-Type"] = nil
+					}
+					if !test.chunked {
+						w.Header().Set("Content-Length", strconv.Itoa(len(test.content)))
+					}
 					w.WriteHeader(test.statusCode)
+					if test.chunked {
+						// Flushing before writing the body forces a chunked response.
+						w.(http.Flusher).Flush()
+					}
 					if _, err := io.WriteString(w, test.content); err != nil {
 						t.Errorf("Write response: %v", err)
 					}
@@ -463,7 +2492,12 @@ func TestPost(t *testing.T) {
 				if err != nil {
 					t.Fatal(err)
 				}
-				got, err := post(context.Background(), srv.Client(), "", u, nil)
+				opts := Options{
+					HTTPClient:         srv.Client(),
+					LenientContentType: test.lenient,
+					AllowInsecure:      true,
+				}
+				got, err := post(context.Background(), opts, u, nil, FormatForm)
 				if err != nil {
 					t.Log("post:", err)
 					if test.wantErr == nil || !test.wantErr(err) {
@@ -482,6 +2516,335 @@ func TestPost(t *testing.T) {
 	})
 }
 
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url           string
+		allowInsecure bool
+		wantErr       bool
+	}{
+		{url: "https://github.com/login/device/code"},
+		{url: "https://127.0.0.1:8443/login/device/code"},
+		{url: "http://github.com/login/device/code", wantErr: true},
+		{url: "http://github.com/login/device/code", allowInsecure: true, wantErr: true},
+		{url: "http://10.0.0.1/login/device/code", allowInsecure: true, wantErr: true},
+		{url: "http://localhost.example.com/login/device/code", allowInsecure: true, wantErr: true},
+		{url: "http://127.0.0.1:8080/login/device/code", wantErr: true},
+		{url: "http://127.0.0.1:8080/login/device/code", allowInsecure: true},
+		{url: "http://[::1]:8080/login/device/code", allowInsecure: true},
+		{url: "http://localhost/login/device/code", allowInsecure: true},
+		{url: "HTTP://LOCALHOST/login/device/code", allowInsecure: true},
+		{url: "http://github.localhost/login/device/code", allowInsecure: true},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		opts := Options{AllowInsecure: test.allowInsecure}
+		if err := opts.checkURL(u); (err != nil) != test.wantErr {
+			t.Errorf("Options{AllowInsecure: %t}.checkURL(%q) = %v; want error = %t", test.allowInsecure, test.url, err, test.wantErr)
+		}
+	}
+
+	t.Run("Flow", func(t *testing.T) {
+		requested := false
+		opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			requested = true
+			pendingForever(w, r)
+		})
+		opts.AllowInsecure = false
+		if _, err := Flow(context.Background(), opts); err == nil {
+			t.Error("Flow did not return an error")
+		}
+		if requested {
+			t.Error("Flow sent a request over plain http")
+		}
+	})
+}
+
+func TestOptionsClone(t *testing.T) {
+	orig := Options{
+		ClientID:  "cafe1234",
+		Scopes:    []string{"repo", "user"},
+		GitHubURL: &url.URL{Scheme: "https", Host: "github.example.com"},
+		APIURL:    &url.URL{Scheme: "https", Host: "github.example.com", Path: "/api/v3"},
+		Header:    http.Header{"X-Foo": {"bar"}},
+		ClientIDByHost: map[string]string{
+			"github.example.com": "beef5678",
+		},
+	}
+	clone := orig.Clone()
+	clone.ClientIDByHost["github.example.com"] = "deadbeef"
+	clone.Scopes[0] = "gist"
+	clone.GitHubURL.Host = "evil.example.com"
+	clone.APIURL.Path = "/"
+	clone.Header.Set("X-Foo", "baz")
+
+	if want := []string{"repo", "user"}; !cmp.Equal(orig.Scopes, want) {
+		t.Errorf("orig.Scopes = %q; want %q", orig.Scopes, want)
+	}
+	if got, want := orig.GitHubURL.String(), "https://github.example.com"; got != want {
+		t.Errorf("orig.GitHubURL = %q; want %q", got, want)
+	}
+	if got, want := orig.APIURL.String(), "https://github.example.com/api/v3"; got != want {
+		t.Errorf("orig.APIURL = %q; want %q", got, want)
+	}
+	if got, want := orig.Header.Get("X-Foo"), "bar"; got != want {
+		t.Errorf("orig.Header[X-Foo] = %q; want %q", got, want)
+	}
+	if got, want := orig.ClientIDByHost["github.example.com"], "beef5678"; got != want {
+		t.Errorf("orig.ClientIDByHost[github.example.com] = %q; want %q", got, want)
+	}
+}
+
+func TestFlowSlowPoll(t *testing.T) {
+	t.Parallel()
+	const slowness = 1500 * time.Millisecond
+	var mu sync.Mutex
+	var firstDone, secondStart time.Time
+	polls := 0
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		polls++
+		n := polls
+		if n == 2 {
+			secondStart = time.Now()
+		}
+		mu.Unlock()
+		w.Header().Set("Content-Type", formMediaType)
+		if n > 1 {
+			io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+			return
+		}
+		// The first poll takes longer than the 1 second interval.
+		time.Sleep(slowness)
+		mu.Lock()
+		firstDone = time.Now()
+		mu.Unlock()
+		io.WriteString(w, "error=authorization_pending")
+	})
+	if _, err := Flow(context.Background(), opts); err != nil {
+		t.Fatal("Flow:", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if polls != 2 {
+		t.Fatalf("polled %d times; want 2", polls)
+	}
+	// Allow for scheduling jitter, but a fixed tick would send the second
+	// poll right after the first one completes.
+	if gap := secondStart.Sub(firstDone); gap < 900*time.Millisecond {
+		t.Errorf("second poll sent %v after first poll completed; want at least the 1s interval", gap)
+	}
+}
+
+func TestFlowTransportDeadline(t *testing.T) {
+	t.Parallel()
+	stop := make(chan struct{})
+	var polls struct {
+		mu sync.Mutex
+		n  int
+	}
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		polls.mu.Lock()
+		polls.n++
+		n := polls.n
+		polls.mu.Unlock()
+		if n == 1 {
+			// Stall until the middleware's deadline cancels the request.
+			// The server only notices the client going away once it has
+			// read the request body.
+			io.Copy(ioutil.Discard, r.Body)
+			select {
+			case <-r.Context().Done():
+			case <-stop:
+			}
+			return
+		}
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+	})
+	// Registered after startTestServer's cleanup, so this runs first.
+	t.Cleanup(func() { close(stop) })
+	base := opts.HTTPClient.Transport
+	var deadlines struct {
+		mu      sync.Mutex
+		checked bool
+	}
+	opts.HTTPClient = &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			// Middleware that applies its own per-request deadline.
+			if deadline, ok := req.Context().Deadline(); !ok || time.Until(deadline) < time.Second {
+				t.Errorf("request Context deadline = %v, %t; want RequestTimeout from now", deadline, ok)
+			}
+			deadlines.mu.Lock()
+			deadlines.checked = true
+			deadlines.mu.Unlock()
+			ctx, cancel := context.WithTimeout(req.Context(), 100*time.Millisecond)
+			defer cancel()
+			resp, err := base.RoundTrip(req.WithContext(ctx))
+			if err != nil {
+				return nil, err
+			}
+			// Read the body before cancel so that the response is usable.
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+			return resp, nil
+		}),
+	}
+	opts.RequestTimeout = 10 * time.Second
+	result, err := RunFlow(context.Background(), opts)
+	if err != nil {
+		t.Fatal("RunFlow:", err)
+	}
+	if result.Polls != 2 {
+		t.Errorf("result.Polls = %d; want 2 (one timed out by middleware, one success)", result.Polls)
+	}
+	deadlines.mu.Lock()
+	defer deadlines.mu.Unlock()
+	if !deadlines.checked {
+		t.Error("middleware not called")
+	}
+}
+
+func TestFlowClientIDByHost(t *testing.T) {
+	t.Parallel()
+	var got struct {
+		mu       sync.Mutex
+		clientID string
+	}
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		got.mu.Lock()
+		got.clientID = r.PostForm.Get("client_id")
+		got.mu.Unlock()
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, "access_token=xyzzy&token_type=bearer")
+	})
+	opts.ClientID = ""
+	opts.ClientIDByHost = map[string]string{
+		"github.com":        "cafe1234",
+		opts.GitHubURL.Host: "beef5678",
+	}
+	if _, err := Flow(context.Background(), opts); err != nil {
+		t.Fatal("Flow:", err)
+	}
+	got.mu.Lock()
+	defer got.mu.Unlock()
+	if got.clientID != "beef5678" {
+		t.Errorf("client_id = %q; want \"beef5678\"", got.clientID)
+	}
+	if id := (Options{ClientID: "fallback", ClientIDByHost: opts.ClientIDByHost}).clientID(); id != "cafe1234" {
+		t.Errorf("clientID() for github.com = %q; want \"cafe1234\"", id)
+	}
+	if id := (Options{ClientID: "fallback", GitHubURL: &url.URL{Scheme: "https", Host: "other.example.com"}, ClientIDByHost: opts.ClientIDByHost}).clientID(); id != "fallback" {
+		t.Errorf("clientID() for other host = %q; want \"fallback\"", id)
+	}
+}
+
+func TestOptionsEndpoints(t *testing.T) {
+	tests := []struct {
+		name           string
+		opts           Options
+		wantDeviceCode string
+		wantToken      string
+	}{
+		{
+			name:           "Default",
+			wantDeviceCode: "https://github.com/login/device/code",
+			wantToken:      "https://github.com/login/oauth/access_token",
+		},
+		{
+			name: "Enterprise",
+			opts: Options{
+				GitHubURL: &url.URL{Scheme: "https", Host: "github.example.com", Path: "/"},
+			},
+			wantDeviceCode: "https://github.example.com/login/device/code",
+			wantToken:      "https://github.example.com/login/oauth/access_token",
+		},
+		{
+			name:           "GitHubDotCom",
+			opts:           GitHubDotCom(),
+			wantDeviceCode: "https://github.com/login/device/code",
+			wantToken:      "https://github.com/login/oauth/access_token",
+		},
+		{
+			name:           "EnterprisePreset",
+			opts:           Enterprise("github.example.com"),
+			wantDeviceCode: "https://github.example.com/login/device/code",
+			wantToken:      "https://github.example.com/login/oauth/access_token",
+		},
+		{
+			name: "CustomPaths",
+			opts: Options{
+				GitHubURL:      &url.URL{Scheme: "https", Host: "gitea.example.com", Path: "/forge"},
+				DeviceCodePath: "/login/oauth/device",
+				TokenPath:      "login/oauth/token",
+			},
+			wantDeviceCode: "https://gitea.example.com/forge/login/oauth/device",
+			wantToken:      "https://gitea.example.com/forge/login/oauth/token",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.opts.deviceCodeURL().String(); got != test.wantDeviceCode {
+				t.Errorf("deviceCodeURL() = %q; want %q", got, test.wantDeviceCode)
+			}
+			if got := test.opts.tokenURL().String(); got != test.wantToken {
+				t.Errorf("tokenURL() = %q; want %q", got, test.wantToken)
+			}
+		})
+	}
+}
+
+func TestFlowCustomPaths(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/forge/login/oauth/device", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, url.Values{
+			"device_code":      {"xyzzy"},
+			"user_code":        {"DED-BEF"},
+			"verification_uri": {"https://example.com/login/device"},
+			"interval":         {"1"},
+		}.Encode())
+	})
+	mux.HandleFunc("/forge/login/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, "access_token=plugh&token_type=bearer")
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL + "/forge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := Flow(context.Background(), Options{
+		ClientID:       "cafe1234",
+		GitHubURL:      u,
+		AllowInsecure:  true,
+		HTTPClient:     srv.Client(),
+		DeviceCodePath: "/login/oauth/device",
+		TokenPath:      "/login/oauth/token",
+		Prompter: func(context.Context, Prompt) error {
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal("Flow:", err)
+	}
+	if token != "plugh" {
+		t.Errorf("token = %q; want \"plugh\"", token)
+	}
+}
+
 func TestParseSeconds(t *testing.T) {
 	tests := []struct {
 		s               string
@@ -518,6 +2881,31 @@ func TestParseSeconds(t *testing.T) {
 			defaultDuration: 5 * time.Second,
 			want:            5 * time.Second,
 		},
+		{
+			s:               "5.0",
+			defaultDuration: 1 * time.Second,
+			want:            5 * time.Second,
+		},
+		{
+			s:               "5.5",
+			defaultDuration: 1 * time.Second,
+			want:            6 * time.Second,
+		},
+		{
+			s:               "-5.5",
+			defaultDuration: 1 * time.Second,
+			want:            1 * time.Second,
+		},
+		{
+			s:               "NaN",
+			defaultDuration: 1 * time.Second,
+			want:            1 * time.Second,
+		},
+		{
+			s:               "1e100",
+			defaultDuration: 1 * time.Second,
+			want:            1 * time.Second,
+		},
 	}
 	for _, test := range tests {
 		got := parseSeconds(test.s, test.defaultDuration)
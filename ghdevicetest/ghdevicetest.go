@@ -0,0 +1,249 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package ghdevicetest provides a fake GitHub device flow server for testing
+// programs that use gg-scm.io/pkg/ghdevice.
+package ghdevicetest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"gg-scm.io/pkg/ghdevice"
+)
+
+// Config specifies the behavior of a Server.
+type Config struct {
+	// ClientID is the client ID the server accepts. If it is empty, then any
+	// client ID is accepted. Otherwise, requests with a different client ID
+	// receive an "incorrect_client_credentials" error.
+	ClientID string
+
+	// DeviceCode, UserCode, and VerificationURL are the values returned
+	// from the device code endpoint. If empty, placeholder values are used.
+	DeviceCode      string
+	UserCode        string
+	VerificationURL string
+
+	// ExpiresIn is the lifetime of device codes issued by the server.
+	// If it is zero, defaults to 15 minutes.
+	ExpiresIn time.Duration
+	// Interval is the polling interval sent to clients.
+	// It is rounded up to a whole number of seconds.
+	// If it is zero, defaults to 1 second.
+	Interval time.Duration
+
+	// Responses is the sequence of responses to send to access token
+	// requests. The last response is repeated indefinitely. If Responses is
+	// empty, the server responds to every request with Pending.
+	Responses []Response
+}
+
+// Response is a scripted response to an access token request.
+type Response struct {
+	// AccessToken is the token to return if Error is empty.
+	AccessToken string
+	// Error is an OAuth error code, like "authorization_pending".
+	Error string
+	// ErrorDescription is an optional human-readable description of Error.
+	ErrorDescription string
+	// Interval is the new polling interval sent with a "slow_down" error.
+	Interval time.Duration
+}
+
+// Success returns a response that grants the given access token.
+func Success(token string) Response {
+	return Response{AccessToken: token}
+}
+
+// Pending returns a response indicating the user has not yet entered the code.
+func Pending() Response {
+	return Response{Error: "authorization_pending"}
+}
+
+// SlowDown returns a response asking the client to poll less frequently.
+func SlowDown(interval time.Duration) Response {
+	return Response{Error: "slow_down", Interval: interval}
+}
+
+// Denied returns a response indicating the user declined authorization.
+func Denied() Response {
+	return Response{Error: "access_denied", ErrorDescription: "The user has denied your application access."}
+}
+
+// Expired returns a response indicating the device code has expired.
+func Expired() Response {
+	return Response{Error: "expired_token", ErrorDescription: "This 'device_code' has expired."}
+}
+
+// Server is a fake GitHub server that implements the device flow endpoints.
+type Server struct {
+	*httptest.Server
+	cfg Config
+
+	mu          sync.Mutex
+	codeCount   int
+	pollCount   int
+	responseIdx int
+}
+
+// NewServer starts a new Server. The caller should call Close when finished.
+func NewServer(cfg Config) *Server {
+	srv := &Server{cfg: cfg}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/device/code", srv.deviceCode)
+	mux.HandleFunc("/login/oauth/access_token", srv.accessToken)
+	srv.Server = httptest.NewServer(mux)
+	return srv
+}
+
+// Options returns options that direct a flow to the server.
+func (srv *Server) Options() ghdevice.Options {
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		panic(err)
+	}
+	clientID := srv.cfg.ClientID
+	if clientID == "" {
+		clientID = "ghdevicetest"
+	}
+	return ghdevice.Options{
+		ClientID:      clientID,
+		GitHubURL:     u,
+		HTTPClient:    srv.Client(),
+		AllowInsecure: true,
+	}
+}
+
+// DeviceCodes returns the number of device codes the server has issued.
+func (srv *Server) DeviceCodes() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.codeCount
+}
+
+// Polls returns the number of access token requests the server has received.
+func (srv *Server) Polls() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.pollCount
+}
+
+func (srv *Server) deviceCode(w http.ResponseWriter, r *http.Request) {
+	if !srv.checkRequest(w, r) {
+		return
+	}
+	srv.mu.Lock()
+	srv.codeCount++
+	srv.mu.Unlock()
+
+	expiresIn := srv.cfg.ExpiresIn
+	if expiresIn == 0 {
+		expiresIn = 15 * time.Minute
+	}
+	interval := srv.cfg.Interval
+	if interval == 0 {
+		interval = time.Second
+	}
+	writeForm(w, http.StatusOK, url.Values{
+		"device_code":      {stringOr(srv.cfg.DeviceCode, "ghdevicetest-device-code")},
+		"user_code":        {stringOr(srv.cfg.UserCode, "DED-BEF")},
+		"verification_uri": {stringOr(srv.cfg.VerificationURL, "https://github.com/login/device")},
+		"expires_in":       {seconds(expiresIn)},
+		"interval":         {seconds(interval)},
+	})
+}
+
+func (srv *Server) accessToken(w http.ResponseWriter, r *http.Request) {
+	if !srv.checkRequest(w, r) {
+		return
+	}
+	srv.mu.Lock()
+	srv.pollCount++
+	resp := Pending()
+	if len(srv.cfg.Responses) > 0 {
+		resp = srv.cfg.Responses[srv.responseIdx]
+		if srv.responseIdx+1 < len(srv.cfg.Responses) {
+			srv.responseIdx++
+		}
+	}
+	srv.mu.Unlock()
+
+	if resp.Error == "" {
+		writeForm(w, http.StatusOK, url.Values{
+			"access_token": {resp.AccessToken},
+			"token_type":   {"bearer"},
+			"scope":        {""},
+		})
+		return
+	}
+	v := url.Values{"error": {resp.Error}}
+	if resp.ErrorDescription != "" {
+		v.Set("error_description", resp.ErrorDescription)
+	}
+	if resp.Interval > 0 {
+		v.Set("interval", seconds(resp.Interval))
+	}
+	writeForm(w, http.StatusBadRequest, v)
+}
+
+// checkRequest validates the method and client ID of a request, writing an
+// error response and returning false if the request is not acceptable.
+func (srv *Server) checkRequest(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if srv.cfg.ClientID != "" && r.PostForm.Get("client_id") != srv.cfg.ClientID {
+		writeForm(w, http.StatusUnauthorized, url.Values{
+			"error":             {"incorrect_client_credentials"},
+			"error_description": {"The client_id and/or client_secret passed are incorrect."},
+		})
+		return false
+	}
+	return true
+}
+
+func writeForm(w http.ResponseWriter, statusCode int, v url.Values) {
+	body := v.Encode()
+	w.Header().Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(statusCode)
+	io.WriteString(w, body)
+}
+
+// seconds formats d as a whole number of seconds, rounding up.
+func seconds(d time.Duration) string {
+	n := (d + time.Second - 1) / time.Second
+	return strconv.FormatInt(int64(n), 10)
+}
+
+func stringOr(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
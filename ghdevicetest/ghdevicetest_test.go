@@ -0,0 +1,115 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevicetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gg-scm.io/pkg/ghdevice"
+)
+
+func TestServer(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		srv := NewServer(Config{
+			ClientID:  "cafe1234",
+			Responses: []Response{Pending(), Success("xyzzy")},
+		})
+		t.Cleanup(srv.Close)
+		opts := srv.Options()
+		rp := new(RecordingPrompter)
+		opts.Prompter = rp.Prompt
+		token, err := ghdevice.Flow(context.Background(), opts)
+		if err != nil {
+			t.Fatal("Flow:", err)
+		}
+		if token != "xyzzy" {
+			t.Errorf("Flow(...) = %q, <nil>; want \"xyzzy\", <nil>", token)
+		}
+		if prompts := rp.Prompts(); len(prompts) != 1 || prompts[0].UserCode != "DED-BEF" {
+			t.Errorf("prompts = %+v; want a single prompt with code DED-BEF", prompts)
+		}
+		if got := srv.Polls(); got != 2 {
+			t.Errorf("srv.Polls() = %d; want 2", got)
+		}
+	})
+
+	t.Run("Denied", func(t *testing.T) {
+		srv := NewServer(Config{
+			Responses: []Response{Denied()},
+		})
+		t.Cleanup(srv.Close)
+		opts := srv.Options()
+		opts.Prompter = func(context.Context, ghdevice.Prompt) error { return nil }
+		_, err := ghdevice.Flow(context.Background(), opts)
+		if !errors.Is(err, ghdevice.ErrAccessDenied) {
+			t.Errorf("Flow(...) error = %v; want ErrAccessDenied", err)
+		}
+	})
+
+	t.Run("IncorrectClientID", func(t *testing.T) {
+		srv := NewServer(Config{ClientID: "cafe1234"})
+		t.Cleanup(srv.Close)
+		opts := srv.Options()
+		opts.ClientID = "wrong"
+		opts.Prompter = func(context.Context, ghdevice.Prompt) error { return nil }
+		_, err := ghdevice.Flow(context.Background(), opts)
+		if !errors.Is(err, ghdevice.ErrIncorrectClientCredentials) {
+			t.Errorf("Flow(...) error = %v; want ErrIncorrectClientCredentials", err)
+		}
+		if got := srv.DeviceCodes(); got != 0 {
+			t.Errorf("srv.DeviceCodes() = %d; want 0", got)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		srv := NewServer(Config{
+			Responses: []Response{Expired(), Success("xyzzy")},
+		})
+		t.Cleanup(srv.Close)
+		opts := srv.Options()
+		opts.Prompter = func(context.Context, ghdevice.Prompt) error { return nil }
+		if _, err := ghdevice.Flow(context.Background(), opts); err != nil {
+			t.Fatal("Flow:", err)
+		}
+		if got := srv.DeviceCodes(); got != 2 {
+			t.Errorf("srv.DeviceCodes() = %d; want 2", got)
+		}
+	})
+}
+
+func TestRecordingPrompter(t *testing.T) {
+	srv := NewServer(Config{})
+	t.Cleanup(srv.Close)
+	opts := srv.Options()
+	promptErr := errors.New("bork")
+	rp := &RecordingPrompter{Err: promptErr}
+	var _ ghdevice.Prompter = rp
+	opts.Prompter = rp.Prompt
+	_, err := ghdevice.Flow(context.Background(), opts)
+	if !errors.Is(err, promptErr) {
+		t.Errorf("Flow(...) error = %v; want %v", err, promptErr)
+	}
+	prompts := rp.Prompts()
+	if len(prompts) != 1 || prompts[0].UserCode != "DED-BEF" {
+		t.Errorf("prompts = %+v; want a single prompt with code DED-BEF", prompts)
+	}
+	if got := srv.Polls(); got != 0 {
+		t.Errorf("srv.Polls() = %d; want 0", got)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevicetest
+
+import (
+	"context"
+	"sync"
+
+	"gg-scm.io/pkg/ghdevice"
+)
+
+// RecordingPrompter is a ghdevice.Prompter that records every prompt it
+// receives. Use its Prompt method as ghdevice.Options.Prompter. The zero
+// value is ready to use. It is safe to call its methods from multiple
+// goroutines.
+type RecordingPrompter struct {
+	// Err is returned from every call to Prompt. It must not be changed
+	// while a flow is using the prompter.
+	Err error
+
+	mu      sync.Mutex
+	prompts []ghdevice.Prompt
+}
+
+// Prompt records p and returns rp.Err.
+func (rp *RecordingPrompter) Prompt(ctx context.Context, p ghdevice.Prompt) error {
+	rp.mu.Lock()
+	rp.prompts = append(rp.prompts, p)
+	rp.mu.Unlock()
+	return rp.Err
+}
+
+// Prompts returns the prompts received so far, in the order received.
+func (rp *RecordingPrompter) Prompts() []ghdevice.Prompt {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return append([]ghdevice.Prompt(nil), rp.prompts...)
+}
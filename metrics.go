@@ -0,0 +1,56 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice
+
+import "time"
+
+// Metrics is the interface used to record counts of flow outcomes, such as
+// to export them to a monitoring system. Implementations must be safe to call
+// from multiple goroutines if Options are shared among concurrent flows.
+type Metrics interface {
+	// IncFlowStarted is called when RunFlow or Flow starts.
+	IncFlowStarted()
+	// IncFlowSucceeded is called when a flow obtains an access token.
+	IncFlowSucceeded()
+	// IncFlowDenied is called when a flow ends because the user
+	// denied the authorization request.
+	IncFlowDenied()
+	// IncCodeExpired is called when a device code expires before the user
+	// authorizes the application and the flow requests a new code.
+	IncCodeExpired()
+	// IncSlowDown is called when GitHub asks the flow to poll less frequently.
+	IncSlowDown()
+	// ObserveFlowDuration is called with the duration of each finished flow,
+	// regardless of its outcome.
+	ObserveFlowDuration(d time.Duration)
+}
+
+func (opts Options) metrics() Metrics {
+	if opts.Metrics == nil {
+		return nopMetrics{}
+	}
+	return opts.Metrics
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) IncFlowStarted()                     {}
+func (nopMetrics) IncFlowSucceeded()                   {}
+func (nopMetrics) IncFlowDenied()                      {}
+func (nopMetrics) IncCodeExpired()                     {}
+func (nopMetrics) IncSlowDown()                        {}
+func (nopMetrics) ObserveFlowDuration(d time.Duration) {}
@@ -0,0 +1,102 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type countingMetrics struct {
+	mu        sync.Mutex
+	counts    map[string]int
+	durations []time.Duration
+}
+
+func (m *countingMetrics) inc(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counts == nil {
+		m.counts = make(map[string]int)
+	}
+	m.counts[name]++
+}
+
+func (m *countingMetrics) IncFlowStarted()   { m.inc("started") }
+func (m *countingMetrics) IncFlowSucceeded() { m.inc("succeeded") }
+func (m *countingMetrics) IncFlowDenied()    { m.inc("denied") }
+func (m *countingMetrics) IncCodeExpired()   { m.inc("expired") }
+func (m *countingMetrics) IncSlowDown()      { m.inc("slow_down") }
+
+func (m *countingMetrics) ObserveFlowDuration(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.durations = append(m.durations, d)
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	responses := []string{
+		"error=slow_down&interval=1",
+		"error=expired_token",
+		"access_token=xyzzy&token_type=bearer",
+		"error=access_denied",
+	}
+	var progress struct {
+		mu sync.Mutex
+		n  int
+	}
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		progress.mu.Lock()
+		resp := responses[progress.n]
+		if progress.n+1 < len(responses) {
+			progress.n++
+		}
+		progress.mu.Unlock()
+		w.Header().Set("Content-Type", formMediaType)
+		io.WriteString(w, resp)
+	})
+	m := new(countingMetrics)
+	opts.Metrics = m
+	ctx := context.Background()
+	if _, err := Flow(ctx, opts); err != nil {
+		t.Fatal("Flow #1:", err)
+	}
+	if _, err := Flow(ctx, opts); err == nil {
+		t.Fatal("Flow #2 did not return an error")
+	}
+
+	want := map[string]int{
+		"started":   2,
+		"succeeded": 1,
+		"denied":    1,
+		"expired":   1,
+		"slow_down": 1,
+	}
+	if diff := cmp.Diff(want, m.counts); diff != "" {
+		t.Errorf("counts (-want +got):\n%s", diff)
+	}
+	if len(m.durations) != 2 {
+		t.Errorf("ObserveFlowDuration called %d times; want 2", len(m.durations))
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"text/template"
+)
+
+// A Prompter informs the user of the URL to visit and the code to enter.
+// See Options.Prompter for the semantics of the Prompt method. A Prompter's
+// Prompt method can be used as Options.Prompter.
+type Prompter interface {
+	Prompt(ctx context.Context, p Prompt) error
+}
+
+// PrompterFunc is an adapter to allow the use of an ordinary function
+// as a Prompter.
+type PrompterFunc func(context.Context, Prompt) error
+
+// Prompt returns f(ctx, p).
+func (f PrompterFunc) Prompt(ctx context.Context, p Prompt) error {
+	return f(ctx, p)
+}
+
+// DefaultPromptTemplate is the template ConsolePrompter uses
+// if its Template field is empty.
+const DefaultPromptTemplate = "Visit {{.VerificationURL}} in your browser and enter the code {{.UserCode}}\n"
+
+// ConsolePrompter is a Prompter that writes instructions to W,
+// typically os.Stderr.
+type ConsolePrompter struct {
+	W io.Writer
+
+	// Template is a text/template that is executed with the Prompt to produce
+	// the instructions, like "Besuchen Sie {{.VerificationURL}} und geben Sie
+	// den Code {{.UserCode}} ein.\n". If it is empty, DefaultPromptTemplate
+	// is used.
+	Template string
+}
+
+// WriterPrompter returns a ConsolePrompter that writes the default
+// instructions to w.
+func WriterPrompter(w io.Writer) ConsolePrompter {
+	return ConsolePrompter{W: w}
+}
+
+// StderrPrompter returns a ConsolePrompter that writes the default
+// instructions to os.Stderr. Its Prompt method can be used as
+// Options.Prompter, or it can be the Next of a BrowserPrompter.
+func StderrPrompter() ConsolePrompter {
+	return WriterPrompter(os.Stderr)
+}
+
+// Prompt writes the verification URL and user code to cp.W.
+func (cp ConsolePrompter) Prompt(ctx context.Context, p Prompt) error {
+	text := cp.Template
+	if text == "" {
+		text = DefaultPromptTemplate
+	}
+	tmpl, err := template.New("prompt").Parse(text)
+	if err != nil {
+		return fmt.Errorf("console prompt: %w", err)
+	}
+	if err := tmpl.Execute(cp.W, p); err != nil {
+		return fmt.Errorf("console prompt: %w", err)
+	}
+	return nil
+}
+
+// BrowserPrompter is a Prompter that opens the verification URL in the user's
+// web browser and then calls Next, if it is not nil. Next is usually a
+// ConsolePrompter, since the user still needs to see the code. Failing to open
+// the browser is not an error: the user can still visit the URL shown by Next.
+type BrowserPrompter struct {
+	Next Prompter
+}
+
+// Prompt opens p.VerificationURL in a web browser and calls bp.Next.
+// Only http and https URLs are opened, since the URL comes from the server
+// and other schemes could run local programs.
+func (bp BrowserPrompter) Prompt(ctx context.Context, p Prompt) error {
+	if u, err := browserURL(p.VerificationURL); err == nil {
+		// Ignore the error: there may be no browser (e.g. over SSH).
+		_ = openBrowser(ctx, u)
+	}
+	if bp.Next == nil {
+		return nil
+	}
+	return bp.Next.Prompt(ctx, p)
+}
+
+// browserURL checks that s is an absolute http or https URL
+// and returns it in canonical form.
+func browserURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", fmt.Errorf("open %q in browser: scheme is not http or https", s)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("open %q in browser: missing host", s)
+	}
+	return u.String(), nil
+}
+
+// openBrowser opens u in the user's web browser. It is a variable
+// so that tests can replace it.
+var openBrowser = func(ctx context.Context, u string) error {
+	var c *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		c = exec.CommandContext(ctx, "open", u)
+	case "windows":
+		c = exec.CommandContext(ctx, "rundll32", "url.dll,FileProtocolHandler", u)
+	default:
+		c = exec.CommandContext(ctx, "xdg-open", u)
+	}
+	return c.Run()
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestConsolePrompter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	p := Prompt{
+		VerificationURL: "https://example.com/login/device",
+		UserCode:        "DED-BEF",
+	}
+	if err := (ConsolePrompter{W: buf}).Prompt(context.Background(), p); err != nil {
+		t.Fatal("Prompt:", err)
+	}
+	const want = "Visit https://example.com/login/device in your browser and enter the code DED-BEF\n"
+	if got := buf.String(); got != want {
+		t.Errorf("output = %q; want %q", got, want)
+	}
+
+	t.Run("Template", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		cp := ConsolePrompter{
+			W:        buf,
+			Template: "Ouvrez {{.VerificationURL}} et saisissez le code {{.UserCode}}\n",
+		}
+		if err := cp.Prompt(context.Background(), p); err != nil {
+			t.Fatal("Prompt:", err)
+		}
+		const want = "Ouvrez https://example.com/login/device et saisissez le code DED-BEF\n"
+		if got := buf.String(); got != want {
+			t.Errorf("output = %q; want %q", got, want)
+		}
+	})
+
+	t.Run("WriterPrompter", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		if err := WriterPrompter(buf).Prompt(context.Background(), p); err != nil {
+			t.Fatal("Prompt:", err)
+		}
+		if got := buf.String(); got != want {
+			t.Errorf("output = %q; want %q", got, want)
+		}
+	})
+
+	t.Run("BadTemplate", func(t *testing.T) {
+		cp := ConsolePrompter{
+			W:        new(bytes.Buffer),
+			Template: "{{.NoSuchField}}",
+		}
+		if err := cp.Prompt(context.Background(), p); err == nil {
+			t.Error("Prompt did not return an error")
+		}
+	})
+}
+
+func TestBrowserPrompter(t *testing.T) {
+	var opened []string
+	openBrowserErr := errors.New("no browser")
+	oldOpenBrowser := openBrowser
+	openBrowser = func(ctx context.Context, u string) error {
+		opened = append(opened, u)
+		return openBrowserErr
+	}
+	t.Cleanup(func() { openBrowser = oldOpenBrowser })
+
+	p := Prompt{
+		VerificationURL: "https://example.com/login/device",
+		UserCode:        "DED-BEF",
+	}
+	var got []Prompt
+	nextErr := errors.New("bork")
+	bp := BrowserPrompter{
+		Next: PrompterFunc(func(ctx context.Context, p Prompt) error {
+			got = append(got, p)
+			return nextErr
+		}),
+	}
+	if err := bp.Prompt(context.Background(), p); err != nextErr {
+		t.Errorf("Prompt(...) = %v; want %v", err, nextErr)
+	}
+	if len(opened) != 1 || opened[0] != p.VerificationURL {
+		t.Errorf("opened %q; want [%q]", opened, p.VerificationURL)
+	}
+	if len(got) != 1 || !cmp.Equal(got[0], p) {
+		t.Errorf("Next called with %+v; want [%+v]", got, p)
+	}
+
+	if err := (BrowserPrompter{}).Prompt(context.Background(), p); err != nil {
+		t.Errorf("BrowserPrompter{}.Prompt(...) = %v; want <nil>", err)
+	}
+
+	t.Run("UnsafeURL", func(t *testing.T) {
+		unsafe := []string{
+			"file:///etc/passwd",
+			"/usr/bin/calc",
+			"-a Calculator",
+			"javascript:alert(1)",
+			"C:\\Windows\\System32\\calc.exe",
+			"https:///login/device",
+		}
+		for _, u := range unsafe {
+			opened = nil
+			got = nil
+			p := Prompt{VerificationURL: u, UserCode: "DED-BEF"}
+			if err := bp.Prompt(context.Background(), p); err != nextErr {
+				t.Errorf("Prompt(%q) = %v; want %v", u, err, nextErr)
+			}
+			if len(opened) != 0 {
+				t.Errorf("Prompt(%q) opened %q", u, opened)
+			}
+			if len(got) != 1 {
+				t.Errorf("Prompt(%q) called Next %d times; want 1", u, len(got))
+			}
+		}
+	})
+}
@@ -0,0 +1,252 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice
+
+import (
+	"fmt"
+	"strings"
+)
+
+// GitHub OAuth scopes that can be used in Options.Scopes.
+// See https://docs.github.com/en/free-pro-team@latest/developers/apps/scopes-for-oauth-apps
+// for what each scope grants.
+const (
+	ScopeRepo           = "repo"
+	ScopeRepoStatus     = "repo:status"
+	ScopeRepoDeployment = "repo_deployment"
+	ScopePublicRepo     = "public_repo"
+	ScopeRepoInvite     = "repo:invite"
+	ScopeSecurityEvents = "security_events"
+
+	ScopeAdminRepoHook = "admin:repo_hook"
+	ScopeWriteRepoHook = "write:repo_hook"
+	ScopeReadRepoHook  = "read:repo_hook"
+
+	ScopeAdminOrg = "admin:org"
+	ScopeWriteOrg = "write:org"
+	ScopeReadOrg  = "read:org"
+
+	ScopeAdminPublicKey = "admin:public_key"
+	ScopeWritePublicKey = "write:public_key"
+	ScopeReadPublicKey  = "read:public_key"
+
+	ScopeAdminOrgHook = "admin:org_hook"
+
+	ScopeGist          = "gist"
+	ScopeNotifications = "notifications"
+
+	ScopeUser       = "user"
+	ScopeReadUser   = "read:user"
+	ScopeUserEmail  = "user:email"
+	ScopeUserFollow = "user:follow"
+
+	ScopeDeleteRepo = "delete_repo"
+
+	ScopeWriteDiscussion = "write:discussion"
+	ScopeReadDiscussion  = "read:discussion"
+
+	ScopeWritePackages  = "write:packages"
+	ScopeReadPackages   = "read:packages"
+	ScopeDeletePackages = "delete:packages"
+
+	ScopeAdminGPGKey = "admin:gpg_key"
+	ScopeWriteGPGKey = "write:gpg_key"
+	ScopeReadGPGKey  = "read:gpg_key"
+
+	ScopeWorkflow = "workflow"
+
+	ScopeProject     = "project"
+	ScopeReadProject = "read:project"
+
+	ScopeCodespace = "codespace"
+
+	ScopeAdminSSHSigningKey = "admin:ssh_signing_key"
+	ScopeWriteSSHSigningKey = "write:ssh_signing_key"
+	ScopeReadSSHSigningKey  = "read:ssh_signing_key"
+
+	ScopeAdminEnterprise         = "admin:enterprise"
+	ScopeManageRunnersEnterprise = "manage_runners:enterprise"
+	ScopeManageBillingEnterprise = "manage_billing:enterprise"
+	ScopeReadEnterprise          = "read:enterprise"
+	ScopeAuditLog                = "audit_log"
+	ScopeReadAuditLog            = "read:audit_log"
+	ScopeCopilot                 = "copilot"
+	ScopeManageBillingCopilot    = "manage_billing:copilot"
+)
+
+// documentedScopes is the list of scopes accepted when Options.StrictScopes
+// is set. It is the only list of scopes to update when GitHub adds one.
+var documentedScopes = []string{
+	ScopeRepo,
+	ScopeRepoStatus,
+	ScopeRepoDeployment,
+	ScopePublicRepo,
+	ScopeRepoInvite,
+	ScopeSecurityEvents,
+	ScopeAdminRepoHook,
+	ScopeWriteRepoHook,
+	ScopeReadRepoHook,
+	ScopeAdminOrg,
+	ScopeWriteOrg,
+	ScopeReadOrg,
+	ScopeAdminPublicKey,
+	ScopeWritePublicKey,
+	ScopeReadPublicKey,
+	ScopeAdminOrgHook,
+	ScopeGist,
+	ScopeNotifications,
+	ScopeUser,
+	ScopeReadUser,
+	ScopeUserEmail,
+	ScopeUserFollow,
+	ScopeDeleteRepo,
+	ScopeWriteDiscussion,
+	ScopeReadDiscussion,
+	ScopeWritePackages,
+	ScopeReadPackages,
+	ScopeDeletePackages,
+	ScopeAdminGPGKey,
+	ScopeWriteGPGKey,
+	ScopeReadGPGKey,
+	ScopeWorkflow,
+	ScopeProject,
+	ScopeReadProject,
+	ScopeCodespace,
+	ScopeAdminSSHSigningKey,
+	ScopeWriteSSHSigningKey,
+	ScopeReadSSHSigningKey,
+	ScopeAdminEnterprise,
+	ScopeManageRunnersEnterprise,
+	ScopeManageBillingEnterprise,
+	ScopeReadEnterprise,
+	ScopeAuditLog,
+	ScopeReadAuditLog,
+	ScopeCopilot,
+	ScopeManageBillingCopilot,
+}
+
+// knownScopes is the set of documentedScopes.
+var knownScopes = make(map[string]struct{}, len(documentedScopes))
+
+func init() {
+	for _, scope := range documentedScopes {
+		knownScopes[scope] = struct{}{}
+	}
+}
+
+// scopeParents maps each scope to the scope that directly includes it.
+// See https://docs.github.com/en/apps/oauth-apps/building-oauth-apps/scopes-for-oauth-apps#available-scopes
+var scopeParents = map[string]string{
+	ScopeRepoStatus:     ScopeRepo,
+	ScopeRepoDeployment: ScopeRepo,
+	ScopePublicRepo:     ScopeRepo,
+	ScopeRepoInvite:     ScopeRepo,
+	ScopeSecurityEvents: ScopeRepo,
+
+	ScopeWriteRepoHook: ScopeAdminRepoHook,
+	ScopeReadRepoHook:  ScopeWriteRepoHook,
+
+	ScopeWriteOrg: ScopeAdminOrg,
+	ScopeReadOrg:  ScopeWriteOrg,
+
+	ScopeWritePublicKey: ScopeAdminPublicKey,
+	ScopeReadPublicKey:  ScopeWritePublicKey,
+
+	ScopeReadUser:   ScopeUser,
+	ScopeUserEmail:  ScopeUser,
+	ScopeUserFollow: ScopeUser,
+
+	ScopeReadDiscussion: ScopeWriteDiscussion,
+	ScopeReadPackages:   ScopeWritePackages,
+
+	ScopeWriteGPGKey: ScopeAdminGPGKey,
+	ScopeReadGPGKey:  ScopeWriteGPGKey,
+
+	ScopeReadProject: ScopeProject,
+
+	ScopeWriteSSHSigningKey: ScopeAdminSSHSigningKey,
+	ScopeReadSSHSigningKey:  ScopeWriteSSHSigningKey,
+
+	ScopeManageRunnersEnterprise: ScopeAdminEnterprise,
+	ScopeManageBillingEnterprise: ScopeAdminEnterprise,
+	ScopeReadEnterprise:          ScopeAdminEnterprise,
+
+	ScopeReadAuditLog: ScopeAuditLog,
+}
+
+// Scopes is a list of OAuth scopes granted to a token.
+type Scopes []string
+
+// Has reports whether scope is in the list, either directly or because the
+// list has a scope that includes it: for example, "repo" includes
+// "public_repo".
+func (s Scopes) Has(scope string) bool {
+	for ; scope != ""; scope = scopeParents[scope] {
+		for _, granted := range s {
+			if granted == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Contains reports whether every one of the required scopes is in the list,
+// as reported by Has.
+func (s Scopes) Contains(required ...string) bool {
+	for _, scope := range required {
+		if !s.Has(scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkScopes returns an error listing the scopes that are not known
+// GitHub OAuth scopes, if any.
+func checkScopes(scopes []string) error {
+	var unknown []string
+	for _, scope := range normalizeScopes(scopes) {
+		if _, ok := knownScopes[scope]; !ok {
+			unknown = append(unknown, scope)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown scopes %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// normalizeScopes returns the scopes with surrounding whitespace trimmed,
+// empty scopes removed, and duplicates removed. The order of first occurrence
+// is preserved. The argument is not modified.
+func normalizeScopes(scopes []string) []string {
+	var result []string
+	seen := make(map[string]struct{}, len(scopes))
+	for _, scope := range scopes {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if _, dup := seen[scope]; dup {
+			continue
+		}
+		seen[scope] = struct{}{}
+		result = append(result, scope)
+	}
+	return result
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestStrictScopes(t *testing.T) {
+	requested := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		ClientID:      "cafe1234",
+		GitHubURL:     u,
+		AllowInsecure: true,
+		HTTPClient:    srv.Client(),
+		Prompter: func(context.Context, Prompt) error {
+			return nil
+		},
+	}
+	opts.StrictScopes = true
+	opts.Scopes = []string{ScopeRepo, "read:users", " read:user ", "bogus"}
+	_, err = Flow(context.Background(), opts)
+	if err == nil {
+		t.Fatal("Flow did not return an error")
+	}
+	t.Log("Flow:", err)
+	if !strings.Contains(err.Error(), "read:users, bogus") {
+		t.Error("error does not list the unknown scopes")
+	}
+	if requested {
+		t.Error("Flow made a request")
+	}
+
+	if _, err := RequestDeviceCode(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "read:users") {
+		t.Errorf("RequestDeviceCode(...) error = %v; want unknown scope error", err)
+	}
+}
+
+func TestCheckScopes(t *testing.T) {
+	for scope := range knownScopes {
+		if err := checkScopes([]string{scope}); err != nil {
+			t.Errorf("checkScopes([%q]) = %v; want <nil>", scope, err)
+		}
+	}
+	for _, scope := range []string{"project", "read:project", "codespace", "admin:enterprise"} {
+		if err := checkScopes([]string{scope}); err != nil {
+			t.Errorf("checkScopes([%q]) = %v; want <nil>", scope, err)
+		}
+	}
+	if err := checkScopes(nil); err != nil {
+		t.Errorf("checkScopes(nil) = %v; want <nil>", err)
+	}
+}
+
+func TestScopesHas(t *testing.T) {
+	granted := Scopes{ScopeRepo, ScopeWriteOrg, ScopeUserEmail}
+	tests := []struct {
+		scope string
+		want  bool
+	}{
+		{ScopeRepo, true},
+		{ScopePublicRepo, true},
+		{ScopeRepoStatus, true},
+		{ScopeWriteOrg, true},
+		{ScopeReadOrg, true},
+		{ScopeAdminOrg, false},
+		{ScopeUserEmail, true},
+		{ScopeUser, false},
+		{ScopeReadUser, false},
+		{ScopeGist, false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := granted.Has(test.scope); got != test.want {
+			t.Errorf("%q.Has(%q) = %t; want %t", granted, test.scope, got, test.want)
+		}
+	}
+	if Scopes(nil).Has(ScopeRepo) {
+		t.Errorf("Scopes(nil).Has(%q) = true; want false", ScopeRepo)
+	}
+}
+
+func TestScopesContains(t *testing.T) {
+	granted := Scopes{ScopeRepo, ScopeUser}
+	if !granted.Contains(ScopeRepo, ScopeReadUser) {
+		t.Errorf("%q.Contains(%q, %q) = false; want true", granted, ScopeRepo, ScopeReadUser)
+	}
+	if granted.Contains(ScopeRepo, ScopeReadOrg) {
+		t.Errorf("%q.Contains(%q, %q) = true; want false", granted, ScopeRepo, ScopeReadOrg)
+	}
+	if !granted.Contains() {
+		t.Errorf("%q.Contains() = false; want true", granted)
+	}
+}
+
+func TestScopeParentsKnown(t *testing.T) {
+	for scope, parent := range scopeParents {
+		if _, ok := knownScopes[scope]; !ok {
+			t.Errorf("scopeParents has unknown scope %q", scope)
+		}
+		if _, ok := knownScopes[parent]; !ok {
+			t.Errorf("scopeParents[%q] = %q, which is not a known scope", scope, parent)
+		}
+	}
+}
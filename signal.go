@@ -0,0 +1,53 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SignalContext returns a copy of parent that is canceled when the process
+// receives one of the given signals, so that a command-line program can stop
+// a flow cleanly when the user presses Ctrl-C. If no signals are given,
+// SignalContext uses os.Interrupt and SIGTERM, which are available on all
+// platforms.
+//
+// The caller must call stop once the Context is no longer needed. stop
+// cancels the Context and restores the default behavior of the signals, so
+// that a second Ctrl-C after stop terminates the program.
+func SignalContext(parent context.Context, signals ...os.Signal) (ctx context.Context, stop func()) {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	ctx, cancel := context.WithCancel(parent)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+	go func() {
+		select {
+		case <-c:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		cancel()
+		signal.Stop(c)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// +build !windows
+
+package ghdevice
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSignalContext(t *testing.T) {
+	t.Run("Signal", func(t *testing.T) {
+		ctx, stop := SignalContext(context.Background(), syscall.SIGUSR1)
+		defer stop()
+		if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-ctx.Done():
+			if !errors.Is(ctx.Err(), context.Canceled) {
+				t.Errorf("ctx.Err() = %v; want %v", ctx.Err(), context.Canceled)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Context not canceled after signal")
+		}
+	})
+	t.Run("Stop", func(t *testing.T) {
+		ctx, stop := SignalContext(context.Background())
+		stop()
+		if ctx.Err() == nil {
+			t.Error("Context not canceled after stop")
+		}
+		stop()
+	})
+	t.Run("ParentCanceled", func(t *testing.T) {
+		parent, cancel := context.WithCancel(context.Background())
+		ctx, stop := SignalContext(parent)
+		defer stop()
+		cancel()
+		if ctx.Err() == nil {
+			t.Error("Context not canceled with its parent")
+		}
+	})
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// transcriptSecrets is the set of request and response fields that are
+// redacted from transcripts.
+var transcriptSecrets = []string{"access_token", "refresh_token", "device_code"}
+
+// transcribe writes a record of an exchange with an OAuth endpoint to
+// opts.Transcript, if set. resp and respValues may be nil if the request
+// failed or the response could not be parsed. Each record is written with
+// a single call to Write.
+//
+// A record looks like:
+//
+//	POST https://github.com/login/oauth/access_token
+//	> client_id=cafe1234&device_code=REDACTED&grant_type=urn%3Aietf%3Aparams%3Aoauth%3Agrant-type%3Adevice_code
+//	< 400 Bad Request
+//	< error=authorization_pending
+func (opts Options) transcribe(method string, u *url.URL, form url.Values, resp *http.Response, respValues url.Values, err error) {
+	if opts.Transcript == nil {
+		return
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%s %v\n", method, u)
+	fmt.Fprintf(buf, "> %s\n", redactTranscript(form))
+	switch {
+	case resp == nil:
+		fmt.Fprintf(buf, "< error: %v\n", err)
+	case respValues == nil:
+		fmt.Fprintf(buf, "< %s\n", resp.Status)
+		fmt.Fprintf(buf, "< (%s body not recorded)\n", resp.Header.Get("Content-Type"))
+	default:
+		fmt.Fprintf(buf, "< %s\n", resp.Status)
+		fmt.Fprintf(buf, "< %s\n", redactTranscript(respValues))
+	}
+	buf.WriteString("\n")
+	opts.Transcript.Write(buf.Bytes())
+}
+
+// redactTranscript encodes v with the values of secret fields replaced.
+func redactTranscript(v url.Values) string {
+	redacted := make(url.Values, len(v))
+	for k, vals := range v {
+		redacted[k] = append([]string(nil), vals...)
+	}
+	for _, k := range transcriptSecrets {
+		for i := range redacted[k] {
+			redacted[k][i] = "REDACTED"
+		}
+	}
+	// Encode sorts by key, which keeps transcripts stable.
+	return redacted.Encode()
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 The gg Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ghdevice
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTranscript(t *testing.T) {
+	t.Parallel()
+	const token = "xyzzy"
+	polls := 0
+	opts := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", formMediaType)
+		polls++
+		if polls == 1 {
+			io.WriteString(w, "error=authorization_pending")
+			return
+		}
+		io.WriteString(w, "access_token="+token+"&refresh_token=plugh&token_type=bearer")
+	})
+	buf := new(bytes.Buffer)
+	opts.Transcript = buf
+	if _, err := Flow(context.Background(), opts); err != nil {
+		t.Fatal("Flow:", err)
+	}
+	transcript := buf.String()
+	t.Logf("Transcript:\n%s", transcript)
+
+	records := strings.Split(strings.TrimSuffix(transcript, "\n\n"), "\n\n")
+	if len(records) != 3 {
+		t.Fatalf("transcript has %d records; want 3", len(records))
+	}
+	want := []string{
+		"POST " + opts.url("/login/device/code").String() + "\n" +
+			"> client_id=cafe1234&scope=\n" +
+			"< 200 OK\n" +
+			"< device_code=REDACTED&expires_in=900&interval=1&user_code=DED-BEF&verification_uri=https%3A%2F%2Fexample.com%2Flogin%2Fdevice&verification_uri_complete=https%3A%2F%2Fexample.com%2Flogin%2Fdevice%3Fuser_code%3DDED-BEF",
+		"POST " + opts.url("/login/oauth/access_token").String() + "\n" +
+			"> client_id=cafe1234&device_code=REDACTED&grant_type=urn%3Aietf%3Aparams%3Aoauth%3Agrant-type%3Adevice_code\n" +
+			"< 200 OK\n" +
+			"< error=authorization_pending",
+		"POST " + opts.url("/login/oauth/access_token").String() + "\n" +
+			"> client_id=cafe1234&device_code=REDACTED&grant_type=urn%3Aietf%3Aparams%3Aoauth%3Agrant-type%3Adevice_code\n" +
+			"< 200 OK\n" +
+			"< access_token=REDACTED&refresh_token=REDACTED&token_type=bearer",
+	}
+	for i := range want {
+		if records[i] != want[i] {
+			t.Errorf("record %d = %q; want %q", i, records[i], want[i])
+		}
+	}
+	for _, secret := range []string{token, "plugh", "xxxxxxxx"} {
+		if strings.Contains(transcript, secret) {
+			t.Errorf("transcript contains secret %q", secret)
+		}
+	}
+}